@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An age is a span of time measured back from some instant. Years, months
+// and days are applied with calendar arithmetic, so "1mo" back from March 31
+// is the last day of February rather than a fixed number of hours.
+type age struct {
+	years, months, days int
+	d                   time.Duration
+}
+
+// before returns the instant that is a before t. Years and months are
+// subtracted first, and if the day of the month doesn't exist in the
+// resulting month, the last day of that month is used instead of
+// overflowing into the next one, as time.AddDate would.
+func (a age) before(t time.Time) time.Time {
+	return addMonths(t, -(a.months+12*a.years)).AddDate(0, 0, -a.days).Add(-a.d)
+}
+
+// addMonths adds n calendar months, which may be negative, to t. If t's day
+// of the month doesn't exist in the resulting month, the last day of that
+// month is used.
+func addMonths(t time.Time, n int) time.Time {
+	y, m, d := t.Date()
+	first := time.Date(y, m+time.Month(n), 1, 0, 0, 0, 0, t.Location())
+	if last := daysIn(first.Year(), first.Month()); d > last {
+		d = last
+	}
+	return time.Date(first.Year(), first.Month(), d, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+// daysIn returns the number of days in the given month.
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// parseAge parses strings like "2y", "6mo", "3w", "10d" or "1y6mo". In
+// addition to the calendar units, anything time.ParseDuration understands
+// ("36h", "90s") is accepted, except for "m": it means minutes to
+// time.ParseDuration, but "2m" is far more likely to be a typo for "2mo", so
+// it's an error. ISO 8601 durations like "P2Y", "P2M" or "P1WT12H" are
+// accepted too.
+func parseAge(s string) (age, error) {
+	var a age
+	orig := s
+	if s == "" {
+		return a, fmt.Errorf("invalid age %q: empty string", orig)
+	}
+	if s == "0" {
+		return a, nil
+	}
+	if s[0] == 'P' {
+		return parseISOAge(s)
+	}
+	for s != "" {
+		i := 0
+		for i < len(s) && (s[i] == '.' || ('0' <= s[i] && s[i] <= '9')) {
+			i++
+		}
+		if i == 0 {
+			return age{}, fmt.Errorf("invalid age %q: expected a number", orig)
+		}
+		num := s[:i]
+		s = s[i:]
+		j := 0
+		for j < len(s) && (s[j] < '0' || s[j] > '9') && s[j] != '.' {
+			j++
+		}
+		if j == 0 {
+			return age{}, fmt.Errorf("invalid age %q: missing unit", orig)
+		}
+		unit := s[:j]
+		s = s[j:]
+		switch unit {
+		case "y", "mo", "w", "d":
+			n, err := strconv.Atoi(num)
+			if err != nil {
+				return age{}, fmt.Errorf("invalid age %q: %q must be a whole number", orig, num+unit)
+			}
+			switch unit {
+			case "y":
+				a.years += n
+			case "mo":
+				a.months += n
+			case "w":
+				a.days += 7 * n
+			case "d":
+				a.days += n
+			}
+		case "m":
+			return age{}, fmt.Errorf("invalid age %q: use mo for months", orig)
+		default:
+			d, err := time.ParseDuration(num + unit)
+			if err != nil {
+				return age{}, fmt.Errorf("invalid age %q: unknown unit %q", orig, strings.TrimSpace(unit))
+			}
+			a.d += d
+		}
+	}
+	return a, nil
+}
+
+// parseTierAge parses the age at which a retention tier starts, like
+// -weekly-after. The tiers keep at most one archive a day, so an age with a
+// part shorter than a day, like "36h", is an error.
+func parseTierAge(s string) (age, error) {
+	a, err := parseAge(s)
+	if err != nil {
+		return age{}, err
+	}
+	if a.d != 0 {
+		return age{}, fmt.Errorf("invalid age %q: retention tiers can't start at less than a whole day; use d, w, mo or y", s)
+	}
+	return a, nil
+}
+
+// parseISOAge parses an ISO 8601 duration such as "P1Y6M", "P2W" or
+// "P1DT12H". Only whole numbers are accepted. In the date part M means
+// months, and after the T it means minutes.
+func parseISOAge(s string) (age, error) {
+	var a age
+	orig := s
+	s = s[1:]
+	if s == "" || s == "T" {
+		return age{}, fmt.Errorf("invalid age %q: no duration after P", orig)
+	}
+	inTime := false
+	for s != "" {
+		if s[0] == 'T' {
+			if inTime {
+				return age{}, fmt.Errorf("invalid age %q: more than one T", orig)
+			}
+			inTime = true
+			s = s[1:]
+			if s == "" {
+				return age{}, fmt.Errorf("invalid age %q: no duration after T", orig)
+			}
+			continue
+		}
+		i := 0
+		for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(s) {
+			return age{}, fmt.Errorf("invalid age %q: want a whole number followed by a unit", orig)
+		}
+		n, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return age{}, fmt.Errorf("invalid age %q: %v", orig, err)
+		}
+		unit := s[i]
+		s = s[i+1:]
+		switch {
+		case !inTime && unit == 'Y':
+			a.years += n
+		case !inTime && unit == 'M':
+			a.months += n
+		case !inTime && unit == 'W':
+			a.days += 7 * n
+		case !inTime && unit == 'D':
+			a.days += n
+		case inTime && unit == 'H':
+			a.d += time.Duration(n) * time.Hour
+		case inTime && unit == 'M':
+			a.d += time.Duration(n) * time.Minute
+		case inTime && unit == 'S':
+			a.d += time.Duration(n) * time.Second
+		default:
+			return age{}, fmt.Errorf("invalid age %q: unknown unit %q", orig, unit)
+		}
+	}
+	return a, nil
+}
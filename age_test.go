@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAgeISO8601(t *testing.T) {
+	tests := []struct {
+		in   string
+		want age
+	}{
+		{"P2Y", age{years: 2}},
+		{"P2M", age{months: 2}},
+		{"P1W", age{days: 7}},
+		{"P1Y6M3D", age{years: 1, months: 6, days: 3}},
+		{"P1DT12H30M", age{days: 1, d: 12*time.Hour + 30*time.Minute}},
+		{"PT90S", age{d: 90 * time.Second}},
+	}
+	for _, tt := range tests {
+		got, err := parseAge(tt.in)
+		if err != nil {
+			t.Errorf("parseAge(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseAge(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+	for _, in := range []string{"P", "PT", "P2", "P1.5Y", "P1H", "PT1D", "P1YT", "P1DT1HT1M"} {
+		if _, err := parseAge(in); err == nil {
+			t.Errorf("parseAge(%q): expected an error, got nil", in)
+		}
+	}
+}
+
+func TestAgeBeforeMonthEnds(t *testing.T) {
+	day := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 8, 30, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		age        string
+		from, want time.Time
+	}{
+		{"P2M", day(2024, 3, 31), day(2024, 1, 31)},
+		{"P1M", day(2024, 3, 31), day(2024, 2, 29)},
+		{"P1M", day(2023, 3, 31), day(2023, 2, 28)},
+		{"P1M", day(2024, 5, 31), day(2024, 4, 30)},
+		{"P3M", day(2024, 1, 15), day(2023, 10, 15)},
+		{"P1Y", day(2024, 2, 29), day(2023, 2, 28)},
+		{"P1M1D", day(2024, 3, 31), day(2024, 2, 28)},
+		{"P2M", day(2024, 4, 30), day(2024, 2, 29)},
+	}
+	for _, tt := range tests {
+		a, err := parseAge(tt.age)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.before(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%s before %s = %s, want %s", tt.age, tt.from.Format("2006-01-02"), got.Format("2006-01-02"), tt.want.Format("2006-01-02"))
+		}
+	}
+}
+
+func TestParseAgeRejectsMinutes(t *testing.T) {
+	if _, err := parseAge("2m"); err == nil || !strings.Contains(err.Error(), "use mo for months") {
+		t.Errorf("parseAge(2m): got error %v, want one suggesting mo", err)
+	}
+	a, err := parseAge("2mo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != (age{months: 2}) {
+		t.Errorf("parseAge(2mo) = %+v, want 2 months", a)
+	}
+}
+
+func TestParseTierAge(t *testing.T) {
+	for _, in := range []string{"0", "2y", "18mo", "8w", "30d", "P1Y6M"} {
+		if _, err := parseTierAge(in); err != nil {
+			t.Errorf("parseTierAge(%q): %v", in, err)
+		}
+	}
+	for _, in := range []string{"36h", "1d12h", "90s", "P1DT12H", "2m"} {
+		if _, err := parseTierAge(in); err == nil {
+			t.Errorf("parseTierAge(%q): expected an error, got nil", in)
+		}
+	}
+	// Other ages, like -min-age, can still be shorter than a day.
+	if _, err := parseAge("36h"); err != nil {
+		t.Errorf("parseAge(36h): %v", err)
+	}
+}
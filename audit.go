@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// The actions recorded in an -audit-log.
+const (
+	// a batch of archives deleted with one tarsnap command
+	auditDelete = "delete"
+	// an archive deleted on its own, with -sequential or after its batch
+	// failed because one of the archives in it was already gone
+	auditDeleteOne = "delete-one"
+	// an archive not deleted because -already-deleted-file lists it
+	auditSkip = "skip"
+)
+
+// auditEntry is one line of an -audit-log.
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Archive string    `json:"archive"`
+	// "deleted", "gone" or "failed"
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// An auditLog appends a JSON line to a file for every archive the deleter
+// deals with, as it happens. It is safe for concurrent use. A nil *auditLog
+// discards everything.
+type auditLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func openAuditLog(name string) (*auditLog, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// record appends a line for each of archives and syncs the file to disk
+// before returning.
+func (l *auditLog) record(action string, archives []string, result string, err error) error {
+	if l == nil || len(archives) == 0 {
+		return nil
+	}
+	e := auditEntry{Time: time.Now().UTC(), Action: action, Result: result}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, name := range archives {
+		e.Archive = name
+		if err := l.enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return l.f.Sync()
+}
+
+func (l *auditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
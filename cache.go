@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// listingCachePath returns the file that caches the archive listing for
+// tarsnap. The name is derived from the config file, key file and cache
+// directory tarsnap is run with, so a listing for one account is never
+// reused for another.
+func listingCachePath(t tarsnapCmd) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(strings.Join(t.baseArgs, "\x00")))
+	return filepath.Join(dir, "tarsnap-old-archives", "listing-"+hex.EncodeToString(sum[:8])), nil
+}
+
+// readListingCache returns the contents of the named cache file if it was
+// written less than ttl before now.
+func readListingCache(name string, ttl time.Duration, now time.Time) ([]byte, bool) {
+	fi, err := os.Stat(name)
+	if err != nil || now.Sub(fi.ModTime()) >= ttl {
+		return nil, false
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// writeListingCache replaces the named cache file with data. The file's
+// modification time records when the listing was fetched.
+func writeListingCache(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A command is one of the subcommands that say what a run should do. Each
+// one sets the flags that used to choose this, so the rest of the program
+// doesn't need to know which command was run.
+type command struct {
+	name    string
+	summary string
+	// flags the command sets, which can't also be given on the command line
+	sets map[string]string
+	// flags that don't apply to the command, which are rejected and left
+	// out of its usage message
+	without []string
+}
+
+// deleteFlags only make a difference when archives are deleted.
+var deleteFlags = []string{
+	"append-deleted", "audit-log", "batch-size", "concurrency", "delay",
+	"group-cachedir", "group-keyfile", "interactive", "max-retries", "no-exec", "on-error", "post-hook",
+	"post-hook-required", "print-kept", "print-stats", "progress",
+	"retry-delay", "retry-jitter", "retry-jitter-seed", "sequential",
+	"simulate-latency", "verify", "yes",
+}
+
+// planFlags only make a difference to a plan, so they don't apply to list.
+var planFlags = []string{
+	"already-deleted-file", "calendar", "calendar-months", "count-only",
+	"daily", "daily-after", "delete-all-matching", "delete-names-file",
+	"dry-run-mark-deleted", "execute-plan", "force", "group-policy",
+	"keep-all-after", "keep-latest", "keep-newest-per-group", "max-age",
+	"max-delete", "metrics-addr", "min-age", "monthly", "monthly-after",
+	"now", "older-than", "plan-out", "policy", "previous-plan",
+	"quiet-gone", "reconcile", "sort", "strict", "target-free",
+	"week-start", "weekly", "weekly-after", "yearly",
+}
+
+var commands = []*command{
+	{
+		name:    "plan",
+		summary: "Print which archives would be kept and which would be deleted, without deleting anything",
+		sets:    map[string]string{"dry-run": "true", "list-only": "false"},
+		without: deleteFlags,
+	},
+	{
+		name:    "delete",
+		summary: "Delete the archives that the plan discards",
+		sets:    map[string]string{"dry-run": "false", "list-only": "false"},
+		// these only work in a dry run
+		without: []string{"count-only", "dry-run-mark-deleted"},
+	},
+	{
+		name:    "list",
+		summary: "Print the archives matching -archive-regex, without planning or deleting anything",
+		sets:    map[string]string{"list-only": "true"},
+		without: append(append([]string(nil), planFlags...), deleteFlags...),
+	},
+}
+
+// parseCommand finds the command named by the first of args, and returns it
+// with the arguments that follow it. If args start with a flag, or are empty,
+// there's no command, for the old form of the command line that chose what
+// to do with -dry-run and -list-only.
+func parseCommand(args []string) (*command, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return nil, args, nil
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c, args[1:], nil
+		}
+	}
+	return nil, nil, fmt.Errorf("unknown command %q, want plan, delete or list", args[0])
+}
+
+// apply sets c's flags in fs. It's an error for any of them, or any flag
+// that doesn't apply to c, to have been set already.
+func (c *command) apply(fs *flag.FlagSet) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if _, ok := c.sets[f.Name]; (ok || slices.Contains(c.without, f.Name)) && err == nil {
+			err = fmt.Errorf("-%s can't be used with the %s command", f.Name, c.name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for name, value := range c.sets {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usage prints the usage message for c, with only the flags that apply to
+// it.
+func (c *command) usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s %s [flags]\n\n%s.\n\nFlags:\n", filepath.Base(os.Args[0]), c.name, c.summary)
+	printFlags(func(name string) bool {
+		_, ok := c.sets[name]
+		return !ok && !slices.Contains(c.without, name)
+	})
+}
+
+// printCommands prints the usage line and the list of commands.
+func printCommands(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintf(out, "Usage: %s <command> [flags]\n\nCommands:\n", filepath.Base(fs.Name()))
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(out, "\nRun with no command, the flags alone choose what to do. This is deprecated.")
+	fmt.Fprintln(out)
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// fileConfig holds the options that can be set in a -config file. Keys are
+// named after the corresponding flags, for example:
+//
+//	archive-regex = ['^db-', '^www-']
+//	monthly-after = "1y"
+//	keyfile = "/root/tarsnap.key"
+//	batch-size = 50
+//
+// The file is a small subset of TOML, read by parseConfig.
+type fileConfig struct {
+	ArchiveRegex      []string `config:"archive-regex"`
+	ExcludeRegex      []string `config:"exclude-regex"`
+	Policy            string   `config:"policy"`
+	MonthlyAfter      string   `config:"monthly-after"`
+	WeeklyAfter       string   `config:"weekly-after"`
+	DailyAfter        string   `config:"daily-after"`
+	WeekStart         string   `config:"week-start"`
+	CalendarMonths    *bool    `config:"calendar-months"`
+	KeepAllAfter      string   `config:"keep-all-after"`
+	MaxAge            string   `config:"max-age"`
+	MinAge            string   `config:"min-age"`
+	KeepLatest        *int     `config:"keep-latest"`
+	Daily             *int     `config:"daily"`
+	Weekly            *int     `config:"weekly"`
+	Monthly           *int     `config:"monthly"`
+	Yearly            *int     `config:"yearly"`
+	Keyfile           string   `config:"keyfile"`
+	Cachedir          string   `config:"cachedir"`
+	TarsnapConfigfile string   `config:"tarsnap-configfile"`
+	TarsnapBin        string   `config:"tarsnap-bin"`
+	AlreadyDeleted    string   `config:"already-deleted-file"`
+	BatchSize         *int     `config:"batch-size"`
+	Timeout           string   `config:"timeout"`
+	Timezone          string   `config:"timezone"`
+	DryRun            *bool    `config:"dry-run"`
+}
+
+// readConfig reads a fileConfig from the named file. Unknown keys are an
+// error, so that a typo doesn't silently fall back to a default.
+func readConfig(name string) (*fileConfig, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := parseConfig(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	c := new(fileConfig)
+	fields := make(map[string]reflect.Value)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		fields[v.Type().Field(i).Tag.Get("config")] = v.Field(i)
+	}
+	var unknown []string
+	for _, key := range sortedKeys(vals) {
+		f, ok := fields[key]
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		if err := setConfigField(f, vals[key]); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", name, key, err)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("%s: unknown options %s", name, strings.Join(unknown, ", "))
+	}
+	return c, nil
+}
+
+// setConfigField sets f, a fileConfig field, to val, a value returned by
+// parseConfig.
+func setConfigField(f reflect.Value, val any) error {
+	switch f.Interface().(type) {
+	case string:
+		s, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("got %v, want a string", val)
+		}
+		f.SetString(s)
+	case []string:
+		a, ok := val.([]string)
+		if !ok {
+			return fmt.Errorf("got %v, want an array of strings", val)
+		}
+		f.Set(reflect.ValueOf(a))
+	case *int:
+		n, ok := val.(int)
+		if !ok {
+			return fmt.Errorf("got %v, want an integer", val)
+		}
+		f.Set(reflect.ValueOf(&n))
+	case *bool:
+		b, ok := val.(bool)
+		if !ok {
+			return fmt.Errorf("got %v, want true or false", val)
+		}
+		f.Set(reflect.ValueOf(&b))
+	default:
+		panic("unsupported config field type " + f.Type().String())
+	}
+	return nil
+}
+
+// parseConfig parses the subset of TOML that a config file needs: each line
+// is blank, a # comment, or a key = value pair, where the value is a string,
+// an integer, true or false, or an array of strings, which may span lines.
+// Strings are "basic", with backslash escapes, or 'literal', which is handy
+// for regular expressions. Tables and the other value types aren't
+// supported. The values are string, int, bool or []string.
+func parseConfig(data string) (map[string]any, error) {
+	p := &configParser{s: data, line: 1}
+	vals := make(map[string]any)
+	for {
+		p.skip(true)
+		if p.s == "" {
+			return vals, nil
+		}
+		if p.s[0] == '[' {
+			return nil, p.errorf("tables aren't supported")
+		}
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		p.skip(false)
+		if !strings.HasPrefix(p.s, "=") {
+			return nil, p.errorf("want = after %s", key)
+		}
+		p.s = p.s[1:]
+		p.skip(false)
+		val, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := vals[key]; ok {
+			return nil, p.errorf("%s is set more than once", key)
+		}
+		vals[key] = val
+		p.skip(false)
+		if p.s != "" && p.s[0] != '\n' && !strings.HasPrefix(p.s, "\r\n") {
+			return nil, p.errorf("want a new line after the value of %s", key)
+		}
+	}
+}
+
+// configParser holds the rest of the file being parsed by parseConfig.
+type configParser struct {
+	s    string
+	line int
+}
+
+func (p *configParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// skip skips spaces, tabs and comments, and new lines too if newlines is
+// true.
+func (p *configParser) skip(newlines bool) {
+	for p.s != "" {
+		switch c := p.s[0]; {
+		case c == ' ' || c == '\t':
+			p.s = p.s[1:]
+		case c == '#':
+			i := strings.IndexByte(p.s, '\n')
+			if i < 0 {
+				i = len(p.s)
+			}
+			p.s = p.s[i:]
+		case newlines && c == '\r' && strings.HasPrefix(p.s, "\r\n"):
+			p.s = p.s[1:]
+		case newlines && c == '\n':
+			p.s = p.s[1:]
+			p.line++
+		default:
+			return
+		}
+	}
+}
+
+func isBareKeyByte(c byte) bool {
+	return c == '-' || c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// key parses a bare or quoted key.
+func (p *configParser) key() (string, error) {
+	if p.s[0] == '"' || p.s[0] == '\'' {
+		return p.str()
+	}
+	i := 0
+	for i < len(p.s) && isBareKeyByte(p.s[i]) {
+		i++
+	}
+	if i == 0 {
+		return "", p.errorf("want a key, got %q", firstLine(p.s))
+	}
+	key := p.s[:i]
+	p.s = p.s[i:]
+	return key, nil
+}
+
+func (p *configParser) value() (any, error) {
+	switch {
+	case p.s == "" || p.s[0] == '\n' || p.s[0] == '\r':
+		return nil, p.errorf("missing value")
+	case p.s[0] == '"' || p.s[0] == '\'':
+		return p.str()
+	case p.s[0] == '[':
+		return p.array()
+	}
+	i := 0
+	for i < len(p.s) && (p.s[i] == '+' || isBareKeyByte(p.s[i])) {
+		i++
+	}
+	word := p.s[:i]
+	p.s = p.s[i:]
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	n, err := strconv.ParseInt(strings.ReplaceAll(word, "_", ""), 10, 0)
+	if err != nil || strings.HasPrefix(word, "_") || strings.HasSuffix(word, "_") || strings.Contains(word, "__") {
+		return nil, p.errorf("invalid value %q: want a string, an integer, true, false or an array of strings", word+firstLine(p.s))
+	}
+	return int(n), nil
+}
+
+// array parses an array of strings.
+func (p *configParser) array() ([]string, error) {
+	p.s = p.s[1:]
+	a := make([]string, 0)
+	for {
+		p.skip(true)
+		if strings.HasPrefix(p.s, "]") {
+			p.s = p.s[1:]
+			return a, nil
+		}
+		if p.s == "" || (p.s[0] != '"' && p.s[0] != '\'') {
+			return nil, p.errorf("arrays may only hold strings")
+		}
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, s)
+		p.skip(true)
+		switch {
+		case strings.HasPrefix(p.s, ","):
+			p.s = p.s[1:]
+		case strings.HasPrefix(p.s, "]"):
+		default:
+			return nil, p.errorf("want , or ] after an array element")
+		}
+	}
+}
+
+// str parses a single-line basic or literal string.
+func (p *configParser) str() (string, error) {
+	quote := p.s[0]
+	if strings.HasPrefix(p.s, strings.Repeat(string(quote), 3)) {
+		return "", p.errorf("multi-line strings aren't supported")
+	}
+	var b strings.Builder
+	for i := 1; i < len(p.s); {
+		c := p.s[i]
+		switch {
+		case c == quote:
+			p.s = p.s[i+1:]
+			return b.String(), nil
+		case c == '\n':
+			return "", p.errorf("unterminated string")
+		case c == '\\' && quote == '"':
+			r, n, err := unescape(p.s[i:])
+			if err != nil {
+				return "", p.errorf("%v", err)
+			}
+			b.WriteRune(r)
+			i += n
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// unescape decodes the TOML escape sequence at the start of s, returning the
+// character and the length of the sequence.
+func unescape(s string) (rune, int, error) {
+	if len(s) < 2 {
+		return 0, 0, errors.New("unterminated string")
+	}
+	if i := strings.IndexByte(`btnfr"\`, s[1]); i >= 0 {
+		return rune("\b\t\n\f\r\"\\"[i]), 2, nil
+	}
+	n := 0
+	switch s[1] {
+	case 'u':
+		n = 4
+	case 'U':
+		n = 8
+	default:
+		return 0, 0, fmt.Errorf("invalid escape %q", s[:2])
+	}
+	if len(s) < 2+n {
+		return 0, 0, fmt.Errorf("invalid escape %q", s)
+	}
+	v, err := strconv.ParseUint(s[2:2+n], 16, 32)
+	if err != nil || !utf8.ValidRune(rune(v)) {
+		return 0, 0, fmt.Errorf("invalid escape %q", s[:2+n])
+	}
+	return rune(v), 2 + n, nil
+}
+
+// firstLine returns s up to the first new line.
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// values returns the flag values set in c, keyed by flag name.
+func (c *fileConfig) values() map[string][]string {
+	v := make(map[string][]string)
+	str := func(name, s string) {
+		if s != "" {
+			v[name] = []string{s}
+		}
+	}
+	num := func(name string, n *int) {
+		if n != nil {
+			v[name] = []string{strconv.Itoa(*n)}
+		}
+	}
+	if len(c.ArchiveRegex) > 0 {
+		v["archive-regex"] = c.ArchiveRegex
+	}
+	if len(c.ExcludeRegex) > 0 {
+		v["exclude-regex"] = c.ExcludeRegex
+	}
+	str("policy", c.Policy)
+	str("monthly-after", c.MonthlyAfter)
+	str("weekly-after", c.WeeklyAfter)
+	str("daily-after", c.DailyAfter)
+	str("week-start", c.WeekStart)
+	if c.CalendarMonths != nil {
+		v["calendar-months"] = []string{strconv.FormatBool(*c.CalendarMonths)}
+	}
+	str("keep-all-after", c.KeepAllAfter)
+	str("max-age", c.MaxAge)
+	str("min-age", c.MinAge)
+	num("keep-latest", c.KeepLatest)
+	num("daily", c.Daily)
+	num("weekly", c.Weekly)
+	num("monthly", c.Monthly)
+	num("yearly", c.Yearly)
+	str("keyfile", c.Keyfile)
+	str("cachedir", c.Cachedir)
+	str("tarsnap-configfile", c.TarsnapConfigfile)
+	str("tarsnap-bin", c.TarsnapBin)
+	str("already-deleted-file", c.AlreadyDeleted)
+	num("batch-size", c.BatchSize)
+	str("timeout", c.Timeout)
+	str("timezone", c.Timezone)
+	if c.DryRun != nil {
+		v["dry-run"] = []string{strconv.FormatBool(*c.DryRun)}
+	}
+	return v
+}
+
+// apply sets the flags in fs from c, skipping any flag that was set on the
+// command line.
+func (c *fileConfig) apply(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, vals := range c.values() {
+		if set[name] {
+			continue
+		}
+		for _, val := range vals {
+			if err := fs.Set(name, val); err != nil {
+				return fmt.Errorf("invalid %s in config file: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// envFlags are the flags that can be set from the environment, for jobs
+// where flags are awkward to pass. A flag given on the command line wins
+// over the environment, which wins over a -config file.
+var envFlags = []struct{ env, flag string }{
+	{"TARSNAP_ARCHIVE_REGEX", "archive-regex"},
+	{"TARSNAP_KEYFILE", "keyfile"},
+	{"TARSNAP_CACHEDIR", "cachedir"},
+}
+
+// applyEnv sets the flags in envFlags from the environment, skipping any
+// flag that was set on the command line and any variable that is empty.
+func applyEnv(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for _, e := range envFlags {
+		val := os.Getenv(e.env)
+		if set[e.flag] || val == "" {
+			continue
+		}
+		if err := fs.Set(e.flag, val); err != nil {
+			return fmt.Errorf("invalid %s: %v", e.env, err)
+		}
+	}
+	return nil
+}
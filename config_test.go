@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	data := `# tarsnap-old-archives
+archive-regex = [
+	'^db-\d+-',   # literal strings keep backslashes
+	"^www-\\d+-",
+]
+monthly-after = "1y" # comment after a value
+"keyfile" = "/root/tarsnap\tkey"
+batch-size = 1_000
+dry-run = false
+exclude-regex = []
+`
+	got, err := parseConfig(strings.ReplaceAll(data, "\n", "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"archive-regex": []string{`^db-\d+-`, `^www-\d+-`},
+		"monthly-after": "1y",
+		"keyfile":       "/root/tarsnap\tkey",
+		"batch-size":    1000,
+		"dry-run":       false,
+		"exclude-regex": []string{},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	for _, data := range []string{
+		"[section]\n",
+		"batch-size\n",
+		"batch-size =\n",
+		"batch-size = 50 60\n",
+		"batch-size = 5.5\n",
+		"keyfile = \"/root/key\n",
+		"keyfile = \"\\x41\"\n",
+		"keyfile = \"\"\"key\"\"\"\n",
+		"archive-regex = [1, 2]\n",
+		"archive-regex = ['a' 'b']\n",
+		"dry-run = yes\n",
+		"dry-run = true\ndry-run = false\n",
+	} {
+		if _, err := parseConfig(data); err == nil {
+			t.Errorf("%q: expected an error, got nil", data)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.toml")
+	data := "keyfile = \"/config/key\"\ncachedir = \"/config/cache\"\nbatch-size = 50\narchive-regex = ['^db-']\n"
+	if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := readConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same order as main: the command line, then the environment,
+	// then the file
+	parse := func(args ...string) *flag.FlagSet {
+		t.Helper()
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		var regexes stringsFlag
+		fs.Var(&regexes, "archive-regex", "")
+		fs.String("keyfile", "", "")
+		fs.String("cachedir", "", "")
+		fs.Int("batch-size", 100, "")
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyEnv(fs); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.apply(fs); err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	}
+	get := func(fs *flag.FlagSet, name string) string {
+		return fs.Lookup(name).Value.String()
+	}
+
+	fs := parse()
+	for flagName, want := range map[string]string{"keyfile": "/config/key", "cachedir": "/config/cache", "batch-size": "50", "archive-regex": "^db-"} {
+		if got := get(fs, flagName); got != want {
+			t.Errorf("config only: -%s is %q, want %q", flagName, got, want)
+		}
+	}
+
+	t.Setenv("TARSNAP_KEYFILE", "/env/key")
+	t.Setenv("TARSNAP_ARCHIVE_REGEX", "^www-")
+	fs = parse()
+	for flagName, want := range map[string]string{"keyfile": "/env/key", "cachedir": "/config/cache", "archive-regex": "^www-"} {
+		if got := get(fs, flagName); got != want {
+			t.Errorf("env and config: -%s is %q, want %q", flagName, got, want)
+		}
+	}
+
+	fs = parse("-keyfile=/flag/key", "-batch-size=10", "-archive-regex=^mail-")
+	for flagName, want := range map[string]string{"keyfile": "/flag/key", "cachedir": "/config/cache", "batch-size": "10", "archive-regex": "^mail-"} {
+		if got := get(fs, flagName); got != want {
+			t.Errorf("flags, env and config: -%s is %q, want %q", flagName, got, want)
+		}
+	}
+}
+
+func TestReadConfigUnknownKey(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(name, []byte("keyfile = \"/root/key\"\nmonthly_after = \"1y\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readConfig(name); err == nil || !strings.Contains(err.Error(), "unknown options monthly_after") {
+		t.Errorf("got error %v, want one naming monthly_after", err)
+	}
+	if err := os.WriteFile(name, []byte("batch-size = \"50\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readConfig(name); err == nil {
+		t.Error("expected an error for a string batch-size, got nil")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A deletedLog appends the names of deleted archives to an already-deleted
+// file, one per line, so that later runs don't try to delete them again. It
+// is safe for concurrent use. A nil *deletedLog discards everything.
+type deletedLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openDeletedLog(name string) (*deletedLog, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// Make sure we don't glue our first name onto an unterminated last line.
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err != nil && err != io.EOF {
+			f.Close()
+			return nil, err
+		}
+		if last[0] != '\n' {
+			if _, err := f.WriteString("\n"); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+	return &deletedLog{f: f}, nil
+}
+
+// record appends names to the file and syncs it to disk before returning,
+// so the file reflects every deletion confirmed so far even if we crash.
+func (l *deletedLog) record(names []string) error {
+	if l == nil || len(names) == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.WriteString(strings.Join(names, "\n") + "\n"); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *deletedLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// writeMarkedDeleted writes the already-deleted file that would result from
+// deleting items: every name in existing, in order, followed by the names of
+// items that aren't already in it. If name is "-" the file is written to
+// stdout.
+func writeMarkedDeleted(name string, existing []string, items []*archiveItem) error {
+	if name == "-" {
+		return markDeleted(os.Stdout, existing, items)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := markDeleted(f, existing, items); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func markDeleted(w io.Writer, existing []string, items []*archiveItem) error {
+	bw := bufio.NewWriter(w)
+	seen := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		seen[name] = true
+		bw.WriteString(name + "\n")
+	}
+	for _, item := range items {
+		if !seen[item.Name] {
+			seen[item.Name] = true
+			bw.WriteString(item.Name + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// readNames reads archive names from r, one per line, for
+// -delete-names-file. The archives are undated, and are returned in the
+// order they are listed, without duplicates. Blank lines and names with
+// leading or trailing whitespace are errors, since they are more likely to
+// be mistakes than real archive names.
+func readNames(r io.Reader) ([]*archiveItem, error) {
+	items := make([]*archiveItem, 0)
+	seen := make(map[string]bool)
+	bs := bufio.NewScanner(r)
+	for n := 1; bs.Scan(); n++ {
+		name := strings.TrimSuffix(bs.Text(), "\r")
+		switch {
+		case name == "":
+			return nil, fmt.Errorf("line %d is blank", n)
+		case strings.TrimSpace(name) != name:
+			return nil, fmt.Errorf("line %d: archive name %q has leading or trailing whitespace", n, name)
+		case seen[name]:
+			continue
+		}
+		seen[name] = true
+		items = append(items, &archiveItem{Name: name})
+	}
+	if err := bs.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
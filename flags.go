@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// stringsFlag is a flag.Value that collects every value it is given, so the
+// flag can be repeated.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// hiddenFlags are for development, and are left out of the usage message.
+var hiddenFlags = map[string]bool{
+	"no-exec":           true,
+	"simulate-latency":  true,
+	"retry-jitter-seed": true,
+}
+
+// usage prints the usage message for the flags in flag.CommandLine, except
+// hiddenFlags.
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", flag.CommandLine.Name())
+	printFlags(func(string) bool { return true })
+}
+
+// printFlags prints the defaults for the flags in flag.CommandLine that show
+// returns true for, except hiddenFlags.
+func printFlags(show func(name string) bool) {
+	out := flag.CommandLine.Output()
+	visible := flag.NewFlagSet(flag.CommandLine.Name(), flag.ContinueOnError)
+	visible.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] && show(f.Name) {
+			visible.Var(f.Value, f.Name, f.Usage)
+			visible.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	visible.PrintDefaults()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// gfsCounts is the number of daily, weekly, monthly and yearly archives to
+// keep under the grandfather-father-son policy.
+type gfsCounts struct {
+	daily, weekly, monthly, yearly int
+}
+
+func dayKey(t time.Time) string { return t.Format("2006-01-02") }
+
+func weekKey(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
+
+func monthKey(t time.Time) string { return t.Format("2006-01") }
+
+func yearKey(t time.Time) string { return t.Format("2006") }
+
+// planGFS decides which of items, which must be sorted by date, to keep
+// under a grandfather-father-son policy: the most recent archive in each of
+// the last c.daily days, c.weekly weeks, c.monthly months and c.yearly years
+// that have archives is kept, and everything else is discarded. Archives
+// listed in alreadyDeleted are marked as gone. Decisions are returned in the
+// same order as items.
+func planGFS(items []*archiveItem, c gfsCounts, alreadyDeleted map[string]bool) []decision {
+	// the first period that keeps each archive
+	keep := make(map[*archiveItem]string)
+	for _, period := range []struct {
+		name  string
+		count int
+		key   func(time.Time) string
+	}{
+		{"daily", c.daily, dayKey},
+		{"weekly", c.weekly, weekKey},
+		{"monthly", c.monthly, monthKey},
+		{"yearly", c.yearly, yearKey},
+	} {
+		seen := make(map[string]bool)
+		for i := len(items) - 1; i >= 0 && len(seen) < period.count; i-- {
+			if alreadyDeleted[items[i].Name] {
+				continue
+			}
+			k := period.key(items[i].Date)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			if keep[items[i]] == "" {
+				keep[items[i]] = period.name
+			}
+		}
+	}
+	plan := make([]decision, len(items))
+	for i := range items {
+		switch {
+		case alreadyDeleted[items[i].Name]:
+			plan[i] = decision{items[i], actionGone, ""}
+		case keep[items[i]] != "":
+			plan[i] = decision{items[i], actionKeep, keep[items[i]]}
+		default:
+			plan[i] = decision{items[i], actionDiscard, ""}
+		}
+	}
+	return plan
+}
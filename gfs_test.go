@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanGFS(t *testing.T) {
+	// 2024-01-01 is a Monday, the start of ISO week 1.
+	tests := []struct {
+		name    string
+		dates   []string
+		c       gfsCounts
+		deleted []string
+		// labels of the archives that aren't discarded
+		want map[string]string
+	}{
+		{
+			name:  "daily keeps the last archive of each day",
+			dates: []string{"2024-01-01 08:00", "2024-01-01 20:00", "2024-01-02 08:00", "2024-01-02 20:00", "2024-01-03 08:00"},
+			c:     gfsCounts{daily: 2},
+			want:  map[string]string{"2024-01-02 20:00": "keep[daily]", "2024-01-03 08:00": "keep[daily]"},
+		},
+		{
+			name:  "daily skips days without archives",
+			dates: []string{"2024-01-01 08:00", "2024-01-05 08:00", "2024-01-09 08:00"},
+			c:     gfsCounts{daily: 2},
+			want:  map[string]string{"2024-01-05 08:00": "keep[daily]", "2024-01-09 08:00": "keep[daily]"},
+		},
+		{
+			name:  "weekly uses ISO weeks",
+			dates: []string{"2024-01-03 08:00", "2024-01-07 08:00", "2024-01-08 08:00", "2024-01-14 08:00", "2024-01-15 08:00"},
+			c:     gfsCounts{weekly: 2},
+			want:  map[string]string{"2024-01-14 08:00": "keep[weekly]", "2024-01-15 08:00": "keep[weekly]"},
+		},
+		{
+			name:  "monthly",
+			dates: []string{"2023-11-30 08:00", "2023-12-01 08:00", "2023-12-31 08:00", "2024-01-15 08:00"},
+			c:     gfsCounts{monthly: 2},
+			want:  map[string]string{"2023-12-31 08:00": "keep[monthly]", "2024-01-15 08:00": "keep[monthly]"},
+		},
+		{
+			name:  "yearly",
+			dates: []string{"2021-06-01 08:00", "2022-01-01 08:00", "2022-12-31 08:00", "2023-03-01 08:00"},
+			c:     gfsCounts{yearly: 2},
+			want:  map[string]string{"2022-12-31 08:00": "keep[yearly]", "2023-03-01 08:00": "keep[yearly]"},
+		},
+		{
+			name:  "overlapping buckets keep the first period's reason",
+			dates: []string{"2023-06-01 08:00", "2023-12-31 08:00", "2024-01-01 08:00", "2024-01-02 08:00"},
+			c:     gfsCounts{daily: 1, weekly: 1, monthly: 2, yearly: 2},
+			want: map[string]string{
+				"2024-01-02 08:00": "keep[daily]",
+				"2023-12-31 08:00": "keep[monthly]",
+			},
+		},
+		{
+			name:  "each period counts its own buckets",
+			dates: []string{"2023-12-30 08:00", "2023-12-31 08:00", "2024-01-01 08:00", "2024-01-02 08:00"},
+			c:     gfsCounts{daily: 2, weekly: 2},
+			want: map[string]string{
+				"2024-01-01 08:00": "keep[daily]",
+				"2024-01-02 08:00": "keep[daily]",
+				"2023-12-31 08:00": "keep[weekly]",
+			},
+		},
+		{
+			name:    "already deleted archives are gone and don't fill a bucket",
+			dates:   []string{"2024-01-01 08:00", "2024-01-01 20:00", "2024-01-02 08:00", "2024-01-02 20:00"},
+			c:       gfsCounts{daily: 2},
+			deleted: []string{"2024-01-02 20:00"},
+			want: map[string]string{
+				"2024-01-01 20:00": "keep[daily]",
+				"2024-01-02 08:00": "keep[daily]",
+				"2024-01-02 20:00": "gone",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := make([]*archiveItem, len(tt.dates))
+			for i, s := range tt.dates {
+				d, err := time.Parse("2006-01-02 15:04", s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				items[i] = &archiveItem{Name: s, Date: d}
+			}
+			deleted := make(map[string]bool)
+			for _, name := range tt.deleted {
+				deleted[name] = true
+			}
+			plan := planGFS(items, tt.c, deleted)
+			got := make(map[string]string)
+			for i := range plan {
+				if plan[i].Item != items[i] {
+					t.Fatalf("decision %d is for %s, want %s", i, plan[i].Item.Name, items[i].Name)
+				}
+				if plan[i].Action != actionDiscard {
+					got[plan[i].Item.Name] = plan[i].label()
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
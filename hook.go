@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// runPostHook runs command, a program name followed by its arguments
+// separated by spaces, with the counts from stats in its environment. If
+// simulated is true, nothing was really deleted, for -no-exec, and the
+// archives that would have been are passed as TARSNAP_SIMULATED instead of
+// TARSNAP_DELETED.
+func runPostHook(ctx context.Context, command string, stats *runStats, simulated bool) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return errors.New("empty -post-hook command")
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	deleted, pretended := stats.discarded.Load(), int64(0)
+	if simulated {
+		deleted, pretended = 0, deleted
+	}
+	cmd.Env = append(os.Environ(),
+		"TARSNAP_KEPT="+strconv.FormatInt(stats.kept.Load(), 10),
+		"TARSNAP_DELETED="+strconv.FormatInt(deleted, 10),
+		"TARSNAP_SIMULATED="+strconv.FormatInt(pretended, 10),
+		"TARSNAP_GONE="+strconv.FormatInt(stats.gone.Load(), 10),
+		"TARSNAP_ERRORS="+strconv.FormatInt(stats.errors.Load(), 10),
+	)
+	return cmd.Run()
+}
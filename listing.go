@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type listingReader struct {
+	io.Reader
+	close func() error
+}
+
+func (l listingReader) Close() error {
+	return l.close()
+}
+
+// openListing opens a saved archive listing. If name is "-" the listing is
+// read from stdin.
+func openListing(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		r, err := newListingReader(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		return listingReader{r, func() error { return nil }}, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newListingReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return listingReader{r, f.Close}, nil
+}
+
+// newListingReader returns a reader for the archive listing in r. Listings
+// that start with the gzip magic number are decompressed as they are read,
+// so they can be stored compressed.
+func newListingReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// parseOptions controls how an archive listing is parsed.
+type parseOptions struct {
+	// If skipBad is true, lines that can't be parsed are collected instead of
+	// failing the whole listing.
+	skipBad bool
+	// If nameDateFormat is set, it's a time layout for a date embedded in
+	// each archive name, which is used instead of the date tarsnap reports.
+	// Archives without a date in their name keep the date tarsnap reports.
+	// Lines without a date from tarsnap, as printed by --list-archives
+	// without -v, are dated from the name if possible.
+	nameDateFormat string
+	// If verbose is true, the listing is known to come from tarsnap
+	// --list-archives -v, so every line must have a timestamp.
+	verbose bool
+}
+
+// dateFromName finds a date in layout in name. The layout's fields must be
+// fixed width, since every substring of name the length of the reference
+// time formatted in layout is tried in turn.
+func dateFromName(name, layout string) (time.Time, bool) {
+	n := len(time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC).Format(layout))
+	for start := 0; start+n <= len(name); start++ {
+		if d, err := time.Parse(layout, name[start:start+n]); err == nil {
+			return d, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseLine parses one line from tarsnap --list-archives -v. It returns nil
+// and no error for a blank line.
+func parseLine(line string, opts parseOptions) (*archiveItem, error) {
+	if line == "" {
+		return nil, nil
+	}
+	line, size := splitSize(line)
+	// Archive names may contain tabs, but the timestamp is always the
+	// last field, so split on the final tab.
+	i := strings.LastIndexByte(line, '\t')
+	if opts.nameDateFormat != "" {
+		name := line
+		if i >= 0 {
+			name = line[:i]
+		}
+		if d, ok := dateFromName(name, opts.nameDateFormat); ok {
+			return &archiveItem{Date: d, Name: name, Size: size}, nil
+		}
+		// Fall back on the date tarsnap reports, if there is one, so an
+		// archive named some other way doesn't stop the whole listing
+		// from being read.
+	}
+	if i < 0 {
+		// tarsnap --list-archives without -v prints only names.
+		return &archiveItem{Name: line, Size: size}, nil
+	}
+	// 2018-04-21 08:55:35
+	d, err := time.Parse("2006-01-02 15:04:05", line[i+1:])
+	if err != nil {
+		return nil, err
+	}
+	return &archiveItem{Date: d, Name: line[:i], Size: size}, nil
+}
+
+// splitSize removes a trailing size column, which some versions of tarsnap
+// print after the timestamp, from line. The last field is only taken to be a
+// size if it's a whole number and the field before it is a timestamp, so an
+// archive name that happens to end in a tab and some digits is left alone.
+func splitSize(line string) (string, int64) {
+	i := strings.LastIndexByte(line, '\t')
+	if i < 0 {
+		return line, 0
+	}
+	size, err := strconv.ParseInt(line[i+1:], 10, 64)
+	if err != nil || size < 0 {
+		return line, 0
+	}
+	rest := line[:i]
+	j := strings.LastIndexByte(rest, '\t')
+	if j < 0 {
+		return line, 0
+	}
+	if _, err := time.Parse("2006-01-02 15:04:05", rest[j+1:]); err != nil {
+		return line, 0
+	}
+	return rest, size
+}
+
+// IterArchiveItems parses a listing from tarsnap --list-archives -v, yielding
+// each archive as soon as its line has been read. Unlike getArchiveItems,
+// the archives come in the order they are listed, which tarsnap doesn't sort,
+// and duplicates aren't removed. If a line can't be parsed, or r can't be
+// read, the error is yielded with a nil item and iteration ends. The first
+// archive decides whether the listing was made with -v; a later line of the
+// other kind is an error.
+func IterArchiveItems(r io.Reader) iter.Seq2[*archiveItem, error] {
+	return func(yield func(*archiveItem, error) bool) {
+		bs := bufio.NewScanner(r)
+		var first *archiveItem
+		for bs.Scan() {
+			item, err := parseLine(strings.TrimSuffix(bs.Text(), "\r"), parseOptions{})
+			if err == nil && item != nil && first != nil && first.undated() != item.undated() {
+				err = fmt.Errorf("listing mixes lines with and without a timestamp: %q", bs.Text())
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if first == nil {
+				first = item
+			}
+			if item != nil && !yield(item, nil) {
+				return
+			}
+		}
+		if err := bs.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// compareItems orders archives by date, then by name.
+func compareItems(a, b *archiveItem) int {
+	if c := a.Date.Compare(b.Date); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Name, b.Name)
+}
+
+// compareListings compares the archives in a saved listing with the live
+// listing from tarsnap. It returns the set of archives that are only in
+// saved, and the sorted names of the archives that are only in live.
+func compareListings(saved, live []*archiveItem) (notLive map[string]bool, notSaved []string) {
+	liveNames := make(map[string]bool, len(live))
+	for _, item := range live {
+		liveNames[item.Name] = true
+	}
+	savedNames := make(map[string]bool, len(saved))
+	notLive = make(map[string]bool)
+	for _, item := range saved {
+		savedNames[item.Name] = true
+		if !liveNames[item.Name] {
+			notLive[item.Name] = true
+		}
+	}
+	for name := range liveNames {
+		if !savedNames[name] {
+			notSaved = append(notSaved, name)
+		}
+	}
+	slices.Sort(notSaved)
+	return notLive, notSaved
+}
+
+// sortedKeys returns the keys of m, sorted.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// namesIn returns the names of the archives in items that are in set.
+func namesIn(items []*archiveItem, set map[string]bool) []string {
+	var names []string
+	for _, item := range items {
+		if set[item.Name] {
+			names = append(names, item.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sampleListing = `hostname-2018-02-01_18-12-53	2018-02-01 18:12:53
+hostname-2018-01-24_15-19-42	2018-01-24 15:19:42
+hostname-2018-01-13_19-23-43	2018-01-13 19:23:43
+hostname-2018-04-21_08-55-35	2018-04-21 08:55:35
+hostname-2018-12-07_15-56-58-gnupg	2018-12-07 15:56:58
+`
+
+// GenerateListing returns n lines of tarsnap --list-archives -v output for
+// archives named prefix followed by their date, the first created at start
+// and each one after it every later.
+func GenerateListing(start time.Time, every time.Duration, n int, prefix string) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		d := start.Add(time.Duration(i) * every)
+		fmt.Fprintf(&b, "%s%s\t%s\n", prefix, d.Format("2006-01-02_15-04-05"), d.Format("2006-01-02 15:04:05"))
+	}
+	return b.String()
+}
+
+// writeListing writes a listing from GenerateListing to a file in a
+// temporary directory, and returns its name.
+func writeListing(t *testing.T, start time.Time, every time.Duration, n int, prefix string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "listing")
+	if err := os.WriteFile(name, []byte(GenerateListing(start, every, n, prefix)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestOpenListingGzip(t *testing.T) {
+	want, err := getArchiveItems(strings.NewReader(sampleListing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "listing.gz")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := gzip.NewWriter(f)
+	if _, err := gw.Write([]byte(sampleListing)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openListing(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := getArchiveItems(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("gzipped listing parsed differently:\ngot  %v\nwant %v", got, want)
+	}
+}
+
+func TestOpenListingPlain(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "listing")
+	if err := os.WriteFile(name, []byte(sampleListing), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openListing(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	items, err := getArchiveItems(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 5 {
+		t.Errorf("got %d items, want 5", len(items))
+	}
+}
+
+func TestGetArchiveItemsNames(t *testing.T) {
+	tests := []struct {
+		line string
+		name string
+	}{
+		{"hostname-2018-04-21\t2018-04-21 08:55:35", "hostname-2018-04-21"},
+		{"host name 2018-04-21\t2018-04-21 08:55:35", "host name 2018-04-21"},
+		{"host\tname\t2018-04-21 08:55:35", "host\tname"},
+		{" padded \t2018-04-21 08:55:35", " padded "},
+	}
+	for _, tt := range tests {
+		items, err := getArchiveItems(strings.NewReader(tt.line + "\n"))
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if len(items) != 1 || items[0].Name != tt.name {
+			t.Errorf("%q: got %v, want one archive named %q", tt.line, items, tt.name)
+		}
+	}
+}
+
+func TestGetArchiveItemsBadTimestamp(t *testing.T) {
+	for _, line := range []string{
+		"hostname\t2018-04-21",
+		"hostname\t2018-04-21 08:55:35\textra",
+	} {
+		if _, err := getArchiveItems(strings.NewReader(line + "\n")); err == nil {
+			t.Errorf("%q: expected an error, got nil", line)
+		}
+	}
+}
+
+func TestGetArchiveItemsCRLF(t *testing.T) {
+	listing := "hostname-1 \t2018-04-21 08:55:35\r\n" +
+		"host name-2\t2018-04-22 08:55:35\r\n"
+	items, err := getArchiveItems(strings.NewReader(listing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*archiveItem{
+		{Name: "hostname-1 ", Date: time.Date(2018, 4, 21, 8, 55, 35, 0, time.UTC)},
+		{Name: "host name-2", Date: time.Date(2018, 4, 22, 8, 55, 35, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("got %q, want %q", items, want)
+	}
+	// tarsnap --list-archives without -v
+	items, err = getArchiveItems(strings.NewReader("hostname-3\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Name != "hostname-3" {
+		t.Errorf("got %q, want hostname-3", items)
+	}
+}
+
+func TestGetArchiveItemsTwoFields(t *testing.T) {
+	items, err := getArchiveItems(strings.NewReader("host\tname-1\t2018-04-21 08:55:35\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*archiveItem{
+		{Name: "host\tname-1", Date: time.Date(2018, 4, 21, 8, 55, 35, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("got %q, want %q", items, want)
+	}
+}
+
+func TestGetArchiveItemsSizeColumn(t *testing.T) {
+	listing := "hostname-1\t2018-04-21 08:55:35\t123456\n" +
+		"host\tname-2\t2018-04-22 08:55:35\t0\n" +
+		"hostname-3\t2018-04-23 08:55:35\n"
+	items, err := getArchiveItems(strings.NewReader(listing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*archiveItem{
+		{Name: "hostname-1", Date: time.Date(2018, 4, 21, 8, 55, 35, 0, time.UTC), Size: 123456},
+		{Name: "host\tname-2", Date: time.Date(2018, 4, 22, 8, 55, 35, 0, time.UTC)},
+		{Name: "hostname-3", Date: time.Date(2018, 4, 23, 8, 55, 35, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("got %q, want %q", items, want)
+	}
+	// The size column is only recognized after a timestamp.
+	if _, err := getArchiveItems(strings.NewReader("hostname-4\t2018-04-24 08:55:35\t12kB\n")); err == nil {
+		t.Error("expected an error for a size that isn't a number, got nil")
+	}
+}
+
+func TestIterArchiveItems(t *testing.T) {
+	var names []string
+	for item, err := range IterArchiveItems(strings.NewReader(sampleListing)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, item.Name)
+	}
+	// in listing order, not sorted
+	want := strings.Split(strings.TrimSpace(sampleListing), "\n")
+	for i := range want {
+		want[i], _, _ = strings.Cut(want[i], "\t")
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got %q, want %q", names, want)
+	}
+	var errs int
+	for item, err := range IterArchiveItems(strings.NewReader("hostname-1\t2018-04-21 08:55:35\nhostname-2\t2018-04-21\nhostname-3\t2018-04-22 08:55:35\n")) {
+		if err != nil {
+			errs++
+		} else if item.Name != "hostname-1" {
+			t.Errorf("got %s after a bad line", item.Name)
+		}
+	}
+	if errs != 1 {
+		t.Errorf("got %d errors, want 1", errs)
+	}
+}
+
+func TestReadArchiveItemsSkipBad(t *testing.T) {
+	listing := "hostname-1\t2018-04-21 08:55:35\n" +
+		"hostname-2\t2018-04-21\n" +
+		"hostname-3\t2018-04-22 08:55:35\n"
+	items, bad, err := readArchiveItems(strings.NewReader(listing), parseOptions{skipBad: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Name != "hostname-1" || items[1].Name != "hostname-3" {
+		t.Errorf("got items %v, want hostname-1 and hostname-3", items)
+	}
+	if len(bad) != 1 || bad[0] != "hostname-2\t2018-04-21" {
+		t.Errorf("got bad lines %q, want the hostname-2 line", bad)
+	}
+}
+
+func TestNewListingReaderPipe(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		for _, line := range strings.SplitAfter(sampleListing, "\n") {
+			io.WriteString(pw, line)
+		}
+		pw.Close()
+	}()
+	r, err := newListingReader(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := getArchiveItems(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 5 {
+		t.Errorf("got %d items, want 5", len(items))
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	listing := sampleListing + `hostname-2018-01-13_19-23-43	2018-01-13 19:23:43
+hostname-2018-04-21_08-55-35	2018-04-22 08:55:35
+`
+	items, err := getArchiveItems(strings.NewReader(listing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, dupes := dedupe(items)
+	if dupes != 2 {
+		t.Errorf("dupes: got %d, want 2", dupes)
+	}
+	if len(items) != 5 {
+		t.Fatalf("got %d items, want 5", len(items))
+	}
+	seen := make(map[string]bool)
+	for i := range items {
+		if seen[items[i].Name] {
+			t.Errorf("%s is listed more than once", items[i].Name)
+		}
+		seen[items[i].Name] = true
+		if i > 0 && items[i].Date.Before(items[i-1].Date) {
+			t.Errorf("items are not sorted by date: %v before %v", items[i-1], items[i])
+		}
+	}
+	for i := range items {
+		if items[i].Name == "hostname-2018-04-21_08-55-35" && items[i].Date.Day() != 22 {
+			t.Errorf("kept %v, want the most recent entry", items[i].Date)
+		}
+	}
+}
+
+func TestReadArchiveItemsNameDateFormat(t *testing.T) {
+	opts := parseOptions{nameDateFormat: "20060102.1504"}
+	// The date in the name wins; a name without one keeps tarsnap's date.
+	listing := "daily.20240102.0855\t2024-01-05 00:00:00\n" +
+		"weekly-latest\t2024-01-03 00:00:00\n" +
+		"daily.20240101.0855\t2024-01-04 00:00:00\n"
+	items, _, err := readArchiveItems(strings.NewReader(listing), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*archiveItem{
+		{Name: "daily.20240101.0855", Date: time.Date(2024, 1, 1, 8, 55, 0, 0, time.UTC)},
+		{Name: "daily.20240102.0855", Date: time.Date(2024, 1, 2, 8, 55, 0, 0, time.UTC)},
+		{Name: "weekly-latest", Date: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("got %v, want %v", items, want)
+	}
+	if _, _, err := readArchiveItems(strings.NewReader("weekly-latest\tnot a date\n"), opts); err == nil {
+		t.Error("expected an error for a name and timestamp without a date, got nil")
+	}
+}
+
+func TestReadArchiveItemsUndated(t *testing.T) {
+	// tarsnap --list-archives without -v
+	listing := "hostname-2\nhostname-1\n\n"
+	items, _, err := readArchiveItems(strings.NewReader(listing), parseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Name != "hostname-1" || items[1].Name != "hostname-2" {
+		t.Fatalf("got items %v, want hostname-1 and hostname-2", items)
+	}
+	for _, item := range items {
+		if !item.undated() {
+			t.Errorf("%s: got date %v, want undated", item.Name, item.Date)
+		}
+	}
+	items, _, err = readArchiveItems(strings.NewReader("daily.20240101.0855\nweekly-latest\n"), parseOptions{nameDateFormat: "20060102.1504"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || !items[0].undated() || items[0].Name != "weekly-latest" || items[1].undated() {
+		t.Errorf("got items %v, want weekly-latest undated and daily.20240101.0855 dated", items)
+	}
+}
+
+func TestReadArchiveItemsGarbageInVerboseListing(t *testing.T) {
+	listing := "hostname-1\t2018-04-21 08:55:35\n" +
+		"tarsnap: Error reading cache\n" +
+		"hostname-2\t2018-04-22 08:55:35\n"
+	if _, _, err := readArchiveItems(strings.NewReader(listing), parseOptions{}); err == nil {
+		t.Error("expected an error for a line without a timestamp in a -v listing, got nil")
+	}
+	items, bad, err := readArchiveItems(strings.NewReader(listing), parseOptions{skipBad: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Name != "hostname-1" || items[1].Name != "hostname-2" {
+		t.Errorf("got items %v, want hostname-1 and hostname-2", items)
+	}
+	if want := []string{"tarsnap: Error reading cache"}; !reflect.DeepEqual(bad, want) {
+		t.Errorf("got bad lines %q, want %q", bad, want)
+	}
+	// Output from tarsnap itself always has timestamps, even with no
+	// line to compare against.
+	if _, _, err := readArchiveItems(strings.NewReader("tarsnap: Error reading cache\n"), parseOptions{verbose: true}); err == nil {
+		t.Error("expected an error for a line without a timestamp from tarsnap, got nil")
+	}
+	// The first archive decides what kind of listing this is.
+	var errs int
+	for _, err := range IterArchiveItems(strings.NewReader(listing)) {
+		if err != nil {
+			errs++
+		}
+	}
+	if errs != 1 {
+		t.Errorf("IterArchiveItems: got %d errors, want 1", errs)
+	}
+}
+
+func TestCompareListings(t *testing.T) {
+	items := func(names ...string) []*archiveItem {
+		var items []*archiveItem
+		for _, name := range names {
+			items = append(items, &archiveItem{Name: name})
+		}
+		return items
+	}
+	saved := items("both-1", "saved-2", "both-2", "saved-1")
+	live := items("live-2", "both-1", "live-1", "both-2")
+	notLive, notSaved := compareListings(saved, live)
+	if want := map[string]bool{"saved-1": true, "saved-2": true}; !reflect.DeepEqual(notLive, want) {
+		t.Errorf("only in saved: got %v, want %v", notLive, want)
+	}
+	if want := []string{"live-1", "live-2"}; !reflect.DeepEqual(notSaved, want) {
+		t.Errorf("only in live: got %q, want %q", notSaved, want)
+	}
+	notLive, notSaved = compareListings(saved, saved)
+	if len(notLive) != 0 || len(notSaved) != 0 {
+		t.Errorf("same listing: got %v and %q, want no differences", notLive, notSaved)
+	}
+}
+
+func BenchmarkReadArchiveItems(b *testing.B) {
+	// tarsnap doesn't list archives in date order, so neither do we.
+	rnd := rand.New(rand.NewSource(1))
+	start := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	buf := new(bytes.Buffer)
+	for i := 0; i < 500000; i++ {
+		d := start.Add(time.Duration(rnd.Int63n(int64(15 * 365 * 24 * time.Hour)))).Truncate(time.Second)
+		fmt.Fprintf(buf, "hostname-%s\t%s\n", d.Format("2006-01-02_15-04-05"), d.Format("2006-01-02 15:04:05"))
+	}
+	listing := buf.Bytes()
+	b.SetBytes(int64(len(listing)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := readArchiveItems(bytes.NewReader(listing), parseOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReadArchiveItemsGeneratedListing(t *testing.T) {
+	// Two hosts interleaved, so that the listing isn't in date order.
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	n := 10000
+	listing := GenerateListing(start, time.Hour, n, "web-") + GenerateListing(start.Add(30*time.Minute), time.Hour, n, "db-")
+	items, err := getArchiveItems(strings.NewReader(listing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2*n {
+		t.Fatalf("got %d items, want %d", len(items), 2*n)
+	}
+	for i := range items {
+		want := start.Add(time.Duration(i) * 30 * time.Minute)
+		if !items[i].Date.Equal(want) {
+			t.Fatalf("item %d: got %s, want an archive from %v", i, items[i], want)
+		}
+		if prefix := []string{"web-", "db-"}[i%2]; !strings.HasPrefix(items[i].Name, prefix) {
+			t.Fatalf("item %d: got %s, want a %s archive", i, items[i], prefix)
+		}
+	}
+}
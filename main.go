@@ -8,248 +8,1674 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kevinburke/semaphore"
 )
 
-// Tarsnap does not permit concurrent operations
-const concurrency = 1
+// maxArgBytes caps the total length of the archive arguments to a single
+// tarsnap -d command, so that a large -batch-size with long archive names
+// doesn't exceed the operating system's limit on the size of argv (ARG_MAX),
+// which is as low as 256KB on macOS and is shared with the environment.
+const maxArgBytes = 128 * 1024
 
 type archiveItem struct {
 	Date time.Time
 	Name string
+	// Compressed size in bytes, if -sizes was given.
+	Size int64
+	// Value of the "group" capture group in -archive-regex, if any.
+	// Retention is applied to each group separately.
+	Group string
 }
 
 func (a archiveItem) String() string {
+	if a.undated() {
+		return a.Name
+	}
 	return a.Name + "\t" + a.Date.Format("2006-01-02 15:04:05")
 }
 
+// undated reports whether the archive's date is unknown, because it came
+// from a listing made without -v and no date could be found in its name.
+// Undated archives are always kept.
+func (a archiveItem) undated() bool {
+	return a.Date.IsZero()
+}
+
 var errAlreadyDeleted = errors.New("archive already deleted")
 
-func deleteArchives(ctx context.Context, archives []string) error {
-	args := make([]string, len(archives)*2+1)
-	args[0] = "-d"
+// errTransient is wrapped by errors from tarsnap commands that failed
+// because of a network problem, and may succeed if they are retried.
+var errTransient = errors.New("transient tarsnap error")
+
+// isTransient reports whether tarsnap's stderr output describes a network
+// problem, like failing to connect to the tarsnap server.
+func isTransient(stderr string) bool {
+	s := strings.ToLower(stderr)
+	return strings.Contains(s, "connect") ||
+		strings.Contains(s, "network") ||
+		strings.Contains(s, "timed out")
+}
+
+// Tarsnap lists and deletes archives. tarsnapCmd runs the tarsnap binary;
+// other implementations stand in for it in tests and with -no-exec.
+type Tarsnap interface {
+	// ListArchives returns a listing in the format of tarsnap
+	// --list-archives -v.
+	ListArchives(ctx context.Context) (io.Reader, error)
+	// Delete deletes archives in a single operation. It returns
+	// errAlreadyDeleted if any of them doesn't exist, and an error wrapping
+	// errTransient if the failure may go away on a retry.
+	Delete(ctx context.Context, archives []string) error
+}
+
+// tarsnapCmd describes how to run tarsnap: the binary to use, and the
+// arguments to pass to every invocation ahead of the operation flags.
+type tarsnapCmd struct {
+	bin      string
+	baseArgs []string
+	// log each command and how long it took
+	verbose bool
+	// kill commands that run longer than this, if it's positive
+	timeout time.Duration
+	// run commands in their own process group, so they finish even if we
+	// are interrupted
+	ownProcessGroup bool
+	// If freed is not nil, deletes are run with --print-stats and the
+	// compressed size of the data they delete is added to it.
+	freed *atomic.Int64
+}
+
+// newTarsnapCmd returns a tarsnapCmd that runs bin. Empty configfile,
+// keyfile and cachedir values are left out, so tarsnap falls back to its
+// defaults.
+func newTarsnapCmd(bin, configfile, keyfile, cachedir string) tarsnapCmd {
+	args := make([]string, 0)
+	if configfile != "" {
+		args = append(args, "--configfile", configfile)
+	}
+	if keyfile != "" {
+		args = append(args, "--keyfile", keyfile)
+	}
+	if cachedir != "" {
+		args = append(args, "--cachedir", cachedir)
+	}
+	return tarsnapCmd{bin: bin, baseArgs: args}
+}
+
+// run runs tarsnap with args after the base arguments, writing its output to
+// stdout and stderr. If the command takes longer than t.timeout it is killed,
+// and the returned error wraps context.DeadlineExceeded.
+func (t tarsnapCmd) run(ctx context.Context, stdout, stderr io.Writer, args ...string) error {
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	all := make([]string, 0, len(t.baseArgs)+len(args))
+	all = append(all, t.baseArgs...)
+	all = append(all, args...)
+	cmd := exec.CommandContext(ctx, t.bin, all...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if t.ownProcessGroup {
+		setProcessGroup(cmd)
+	}
+	start := time.Now()
+	if t.verbose {
+		slog.Info("running tarsnap", "args", cmd.Args)
+	}
+	err := cmd.Run()
+	if t.verbose {
+		slog.Info("tarsnap finished", "duration", time.Since(start).Round(time.Millisecond))
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("tarsnap %s timed out after %v: %w", args[0], t.timeout, ctx.Err())
+	}
+	return err
+}
+
+// describeArchives names archives for an error message, abbreviating long
+// batches.
+func describeArchives(archives []string) string {
+	const max = 3
+	if len(archives) <= max {
+		return strings.Join(archives, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(archives[:max], ", "), len(archives)-max)
+}
+
+// stderrSnippet returns the first line of tarsnap's stderr, trimmed to a
+// reasonable length and prefixed with ": ", or "" if there was no output.
+func stderrSnippet(stderr string) string {
+	const max = 200
+	line, _, _ := strings.Cut(strings.TrimSpace(stderr), "\n")
+	if line == "" {
+		return ""
+	}
+	if len(line) > max {
+		line = line[:max] + "..."
+	}
+	return ": " + line
+}
+
+// ListArchives runs tarsnap --list-archives -v.
+func (t tarsnapCmd) ListArchives(ctx context.Context) (io.Reader, error) {
+	buf := new(bytes.Buffer)
+	if err := t.run(ctx, buf, nil, "--list-archives", "-v"); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Delete deletes archives with a single tarsnap -d command.
+func (t tarsnapCmd) Delete(ctx context.Context, archives []string) error {
+	args := make([]string, 0, len(archives)*2+2)
+	args = append(args, "-d")
+	if t.freed != nil {
+		args = append(args, "--print-stats")
+	}
 	for i := range archives {
-		args[i*2+1] = "-f"
-		args[i*2+2] = archives[i]
+		args = append(args, "-f", archives[i])
 	}
 	buf := new(bytes.Buffer)
 	errBuf := new(bytes.Buffer)
-	cmd := exec.CommandContext(ctx, "tarsnap", args...)
-	cmd.Stdout = buf
-	cmd.Stderr = errBuf
-	err := cmd.Run()
+	err := t.run(ctx, buf, errBuf, args...)
 	if err != nil {
 		if strings.Contains(errBuf.String(), "Archive does not exist") {
 			return errAlreadyDeleted
 		}
-		io.Copy(os.Stderr, errBuf)
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.Error("tarsnap delete timed out", "archives", archives, "timeout", t.timeout)
+			return fmt.Errorf("deleting %s: %w", describeArchives(archives), err)
+		}
+		slog.Error("tarsnap delete failed", "archives", archives, "stderr", strings.TrimSpace(errBuf.String()))
+		err = fmt.Errorf("deleting %s: %w%s", describeArchives(archives), err, stderrSnippet(errBuf.String()))
+		if isTransient(errBuf.String()) {
+			return fmt.Errorf("%w: %w", errTransient, err)
+		}
 		return err
 	}
-	io.Copy(os.Stderr, errBuf)
-	for i := 2; i < len(args); i += 2 {
-		fmt.Println("deleted", args[i])
+	if errBuf.Len() > 0 {
+		slog.Warn("tarsnap delete", "archives", archives, "stderr", strings.TrimSpace(errBuf.String()))
+	}
+	if t.freed != nil {
+		n, err := parseDeletedBytes(buf)
+		if err != nil {
+			slog.Warn("could not read the space freed from tarsnap --print-stats", "archives", archives, "err", err)
+		}
+		t.freed.Add(n)
 	}
 	return nil
 }
 
+// noExecTarsnap lists archives with Tarsnap, but doesn't delete anything:
+// each Delete takes latency and then succeeds. It's for -no-exec, to try out
+// batching and progress output without touching real archives.
+type noExecTarsnap struct {
+	Tarsnap
+	latency time.Duration
+}
+
+func (n noExecTarsnap) Delete(ctx context.Context, archives []string) error {
+	select {
+	case <-time.After(n.latency):
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("deleting %s: %w", describeArchives(archives), ctx.Err())
+	}
+}
+
+// deleteArchives deletes archives with a single call to t.Delete, and prints
+// each one once it's gone.
+func deleteArchives(ctx context.Context, t Tarsnap, archives []string) error {
+	if err := t.Delete(ctx, archives); err != nil {
+		return err
+	}
+	for i := range archives {
+		fmt.Println("deleted", archives[i])
+	}
+	return nil
+}
+
+// dedupe removes archives with the same name from items, which must be
+// sorted by date, keeping the most recent entry for each name. It returns the
+// remaining items, still sorted, and the number that were removed.
+func dedupe(items []*archiveItem) ([]*archiveItem, int) {
+	latest := make(map[string]int, len(items))
+	for i := range items {
+		latest[items[i].Name] = i
+	}
+	if len(latest) == len(items) {
+		return items, 0
+	}
+	deduped := make([]*archiveItem, 0, len(latest))
+	for i := range items {
+		if latest[items[i].Name] == i {
+			deduped = append(deduped, items[i])
+		}
+	}
+	return deduped, len(items) - len(deduped)
+}
+
+// compileArchiveRegex compiles regex, allowing it to match anywhere in an
+// archive name unless it is anchored with ^ or $. If strict is true, regex
+// must be anchored at both ends and is compiled as is. If ignoreCase is true,
+// the regex matches without regard to case, as if it started with (?i).
+func compileArchiveRegex(regex string, strict, ignoreCase bool) (*regexp.Regexp, error) {
+	if regex == "" {
+		return nil, errors.New("please provide archive regex")
+	}
+	if strict {
+		if regex[0] != '^' || regex[len(regex)-1] != '$' {
+			return nil, fmt.Errorf("regex %q must start with ^ and end with $ when -strict-regex is set", regex)
+		}
+	} else {
+		if regex[0] != '^' {
+			regex = ".*" + regex
+		}
+		if regex[len(regex)-1] != '$' {
+			regex = regex + ".*"
+		}
+	}
+	if ignoreCase {
+		regex = "(?i)" + regex
+	}
+	return regexp.Compile(regex)
+}
+
+// matchesAny reports whether name matches at least one of rxs.
+func matchesAny(rxs []*regexp.Regexp, name string) bool {
+	for _, rx := range rxs {
+		if rx.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGroup reports whether name matches at least one of rxs. If the first
+// regex to match has a capture group named "group", its value is returned as
+// well.
+func matchGroup(rxs []*regexp.Regexp, name string) (group string, ok bool) {
+	for _, rx := range rxs {
+		m := rx.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		if i := rx.SubexpIndex("group"); i >= 0 {
+			return m[i], true
+		}
+		return "", true
+	}
+	return "", false
+}
+
+// dateSegment matches an archive name segment that holds a date, like
+// "2024-01-01", "20240101" or "2024-01-01_03-00-00".
+var dateSegment = regexp.MustCompile(`^\d{4}-?\d{2}-?\d{2}([T_ -]?\d{2}[-:]?\d{2}([-:]?\d{2})?)?$`)
+
+// prefixGroup returns the part of name before its last sep, if the segment
+// after it looks like a date. "backup/daily/2024-01-01" is in the group
+// "backup/daily". Names that don't end in a date are put in the default
+// group.
+func prefixGroup(name, sep string) string {
+	i := strings.LastIndex(name, sep)
+	if i < 0 || !dateSegment.MatchString(name[i+len(sep):]) {
+		return ""
+	}
+	return name[:i]
+}
+
+// inWindow reports whether d is in the window [after, before). A zero after
+// or before leaves that side of the window open.
+func inWindow(d, after, before time.Time) bool {
+	if !after.IsZero() && d.Before(after) {
+		return false
+	}
+	if !before.IsZero() && !d.Before(before) {
+		return false
+	}
+	return true
+}
+
+// setLocation reinterprets the dates of items, which tarsnap reports without
+// a time zone, as wall clock times in loc.
+func setLocation(items []*archiveItem, loc *time.Location) {
+	for i := range items {
+		if items[i].undated() {
+			continue
+		}
+		d := items[i].Date
+		items[i].Date = time.Date(d.Year(), d.Month(), d.Day(), d.Hour(), d.Minute(), d.Second(), d.Nanosecond(), loc)
+	}
+}
+
 func getArchiveItems(r io.Reader) ([]*archiveItem, error) {
+	items, _, err := readArchiveItems(r, parseOptions{})
+	return items, err
+}
+
+// readArchiveItems parses a listing from tarsnap --list-archives -v. If
+// opts.skipBad is true, lines that can't be parsed are returned in bad
+// instead of failing the whole listing. Items are sorted by date, then name,
+// so the order doesn't depend on the order of the listing.
+//
+// A listing made without -v has only names, which are returned as undated
+// archives with a zero Date. That's only allowed if no line in the listing
+// has a timestamp, and opts.verbose is false: in a listing made with -v, a
+// line without a timestamp is stray output or corruption, not an archive, so
+// it's an error, or bad if opts.skipBad is true.
+func readArchiveItems(r io.Reader, opts parseOptions) (items []*archiveItem, bad []string, err error) {
 	bs := bufio.NewScanner(r)
-	items := make([]*archiveItem, 0)
+	items = make([]*archiveItem, 0)
+	var nameOnly []string
+	var nameOnlyItems []*archiveItem
+	hasTimestamps := opts.verbose
 	for bs.Scan() {
-		line := bs.Text()
-		if count := strings.Count(line, "\t"); count != 1 {
-			return nil, fmt.Errorf("wrong number of tabs in line: want 1 got %d: %q", count, line)
-		}
-		parts := strings.SplitN(line, "\t", 2)
-		// 2018-04-21 08:55:35
-		d, err := time.Parse("2006-01-02 15:04:05", parts[1])
+		// Drop the \r from listings saved with CRLF line endings, but leave
+		// any other whitespace alone: it may be part of an archive name.
+		line := strings.TrimSuffix(bs.Text(), "\r")
+		item, err := parseLine(line, opts)
 		if err != nil {
-			return nil, err
+			if opts.skipBad {
+				bad = append(bad, line)
+				continue
+			}
+			return nil, nil, err
 		}
-		items = append(items, &archiveItem{
-			Date: d,
-			Name: parts[0],
-		})
+		if item == nil {
+			continue
+		}
+		if strings.IndexByte(line, '\t') < 0 {
+			nameOnly = append(nameOnly, line)
+			nameOnlyItems = append(nameOnlyItems, item)
+			continue
+		}
+		hasTimestamps = true
+		items = append(items, item)
 	}
 	if err := bs.Err(); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	switch {
+	case len(nameOnly) == 0:
+	case !hasTimestamps:
+		items = nameOnlyItems
+	case opts.skipBad:
+		bad = append(bad, nameOnly...)
+	default:
+		return nil, nil, fmt.Errorf("line without a timestamp in a listing made with -v: %q", nameOnly[0])
 	}
-	sort.Slice(items, func(i, j int) bool {
-		return items[i].Date.Before(items[j].Date)
-	})
-	return items, nil
+	slices.SortFunc(items, compareItems)
+	return items, bad, nil
 }
 
-func dryRunPrint(dryRun bool, args ...interface{}) {
-	if dryRun {
-		fmt.Println(args...)
+// fsck runs tarsnap --fsck, logging its output, and returns an error if it
+// fails.
+func fsck(ctx context.Context, t tarsnapCmd) error {
+	out := new(bytes.Buffer)
+	err := t.run(ctx, out, out, "--fsck")
+	if s := strings.TrimSpace(out.String()); s != "" {
+		slog.Info("tarsnap --fsck", "output", s)
 	}
+	if err != nil {
+		return fmt.Errorf("tarsnap --fsck: %w%s", err, stderrSnippet(out.String()))
+	}
+	return nil
 }
 
-func main() {
-	dryRun := flag.Bool("dry-run", true, "Dry run mode")
-	file := flag.String("file", "", "Name of file to load archives from")
-	batchSize := flag.Int("batch-size", 100, "Batch size")
-	// one entry per line
-	alreadyDeleted := flag.String("already-deleted-file", "", "Name of file to load already deleted archives from")
-	var regex string
-	flag.StringVar(&regex, "archive-regex", "", "Regular expression to match archives against")
-	flag.Parse()
-	if *batchSize <= 0 {
-		log.Fatal("please provide a positive batch size")
+// runStats counts what happened to the matched archives during a run. It is
+// safe for concurrent use.
+type runStats struct {
+	kept      atomic.Int64
+	discarded atomic.Int64
+	gone      atomic.Int64
+	errors    atomic.Int64
+	// compressed bytes freed by deletes, with -print-stats
+	freed atomic.Int64
+	// if not nil, counts are mirrored here
+	metrics *metrics
+}
+
+func (s *runStats) addKept(n int64) {
+	s.kept.Add(n)
+	if s.metrics != nil {
+		s.metrics.kept.Add(n)
 	}
-	if regex == "" {
-		log.Fatal("please provide archive regex")
+}
+
+func (s *runStats) addDiscarded(n int64) {
+	s.discarded.Add(n)
+	if s.metrics != nil {
+		s.metrics.discarded.Add(n)
 	}
-	if regex[0] != '^' {
-		regex = ".*" + regex
+}
+
+func (s *runStats) addGone(n int64) {
+	s.gone.Add(n)
+	if s.metrics != nil {
+		s.metrics.gone.Add(n)
 	}
-	if regex[len(regex)-1] != '$' {
-		regex = regex + ".*"
+}
+
+func (s *runStats) addErrors(n int64) {
+	s.errors.Add(n)
+	if s.metrics != nil {
+		s.metrics.failed.Add(n)
 	}
-	rx, err := regexp.Compile(regex)
-	if err != nil {
-		log.Fatal(err)
+}
+
+func (s *runStats) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.Int64("kept", s.kept.Load()),
+		slog.Int64("discarded", s.discarded.Load()),
+		slog.Int64("gone", s.gone.Load()),
+		slog.Int64("errors", s.errors.Load()),
 	}
-	alreadyDeletedMap := make(map[string]bool)
-	if *alreadyDeleted != "" {
-		data, err := os.ReadFile(*alreadyDeleted)
-		if err != nil {
-			log.Fatal(err)
-		}
-		lines := strings.Split(string(data), "\n")
-		for i := 0; i < len(lines); i++ {
-			if lines[i] != "" {
-				alreadyDeletedMap[lines[i]] = true
-			}
-		}
+	if n := s.freed.Load(); n > 0 {
+		attrs = append(attrs, slog.Int64("freed_bytes", n))
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	var archives io.Reader
-	if *file != "" {
-		f, err := os.Open(*file)
-		if err != nil {
-			log.Fatal(err)
+	return slog.GroupValue(attrs...)
+}
+
+// A deleter deletes archives from tarsnap, batchSize archives at a time.
+type deleter struct {
+	tarsnap   Tarsnap
+	batchSize int
+	// archives known to be deleted before the run started
+	alreadyDeleted map[string]bool
+	// archives that are deleted, or found to be gone, are recorded here
+	deleted *deletedLog
+	stats   *runStats
+	// every archive dealt with is recorded here, with what happened to it
+	audit *auditLog
+	// If simulated is true, tarsnap isn't really deleting anything, for
+	// -no-exec, and archives are recorded as "simulated" instead of
+	// "deleted".
+	simulated bool
+	// and sent here
+	events *planStream
+	// Deletes that fail with a network error are retried up to maxRetries
+	// times, waiting retryDelay before the first retry and twice as long
+	// before each one after that.
+	maxRetries int
+	retryDelay time.Duration
+	// Each wait before a retry is moved by up to this fraction of itself in
+	// either direction, chosen with jitterRand, so that deletes that failed
+	// together don't all retry at the same moment. jitterRand is guarded by
+	// mu.
+	jitter     float64
+	jitterRand *rand.Rand
+	// If sequential is true, archives are deleted one at a time and progress
+	// is logged after each one. total is the number of archives to delete.
+	sequential bool
+	total      int
+	// if not nil, updated as archives are dealt with
+	progress *progress
+	// if true, archives that turn out to be gone aren't printed
+	quietGone bool
+	// once stop is closed, no more batches are started
+	stop <-chan struct{}
+	// If continueOnError is true, a batch that fails is recorded and the
+	// run carries on, instead of exiting.
+	continueOnError bool
+	// the number of batches deleted at once; zero means one
+	concurrency int
+	// If groupTarsnap isn't empty, archives in the groups it names are
+	// deleted with their own Tarsnap, for -group-keyfile and
+	// -group-cachedir. Each batch is from a single group, and only one
+	// batch from each group is deleted at once. groups maps each archive
+	// to its group, and is set by batches.
+	groupTarsnap map[string]Tarsnap
+	groups       map[string]string
+	// how long to wait before starting each batch after the first
+	delay time.Duration
+
+	mu sync.Mutex
+	// what actually happened to each archive we tried to delete
+	outcomes map[string]string
+	// held while a batch from the group is being deleted
+	groupLocks map[string]*sync.Mutex
+}
+
+// tarsnapFor returns the Tarsnap that deletes the named archive.
+func (d *deleter) tarsnapFor(name string) Tarsnap {
+	if t, ok := d.groupTarsnap[d.groups[name]]; ok {
+		return t
+	}
+	return d.tarsnap
+}
+
+// lockGroup waits until no other batch from the group of the archives in
+// batch is being deleted, if the group has its own Tarsnap, and returns a
+// function that lets the next one go.
+func (d *deleter) lockGroup(batch []string) func() {
+	g := d.groups[batch[0]]
+	if _, ok := d.groupTarsnap[g]; !ok {
+		return func() {}
+	}
+	d.mu.Lock()
+	if d.groupLocks == nil {
+		d.groupLocks = make(map[string]*sync.Mutex)
+	}
+	l := d.groupLocks[g]
+	if l == nil {
+		l = new(sync.Mutex)
+		d.groupLocks[g] = l
+	}
+	d.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (d *deleter) setOutcome(archives []string, action string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.outcomes == nil {
+		d.outcomes = make(map[string]string)
+	}
+	for _, name := range archives {
+		d.outcomes[name] = action
+	}
+}
+
+// applyOutcomes updates the actions in plan to reflect what actually
+// happened during the run.
+func (d *deleter) applyOutcomes(plan []decision) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range plan {
+		if action, ok := d.outcomes[plan[i].Item.Name]; ok {
+			plan[i].Action = action
 		}
-		archives = f
-	} else {
-		buf := new(bytes.Buffer)
-		archiveCmd := exec.CommandContext(ctx, "tarsnap", "--list-archives", "-v")
-		archiveCmd.Stdout = buf
-		if err := archiveCmd.Run(); err != nil {
-			log.Fatal(err)
+	}
+}
+
+// deleteArchives deletes archives, retrying if tarsnap reports a transient
+// network error.
+func (d *deleter) deleteArchives(ctx context.Context, archives []string) error {
+	delay := d.retryDelay
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err := deleteArchives(ctx, d.tarsnapFor(archives[0]), archives)
+		d.stats.metrics.observeBatch(time.Since(start))
+		if !errors.Is(err, errTransient) || attempt >= d.maxRetries {
+			return err
 		}
-		archives = buf
-		tmp, err := os.CreateTemp("", "tarsnap-old-archives-")
-		if err == nil {
-			io.Copy(tmp, buf)
-			fmt.Println("wrote archive output to", tmp.Name())
-			tmp.Close()
+		wait := d.jittered(delay)
+		slog.Warn("retrying delete", "archives", archives, "attempt", attempt+1, "delay", wait, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
 		}
+		delay *= 2
 	}
-	items, err := getArchiveItems(archives)
-	if err != nil {
-		log.Fatal(err)
+}
+
+// jittered returns delay moved by a random amount of up to d.jitter times
+// delay, earlier or later.
+func (d *deleter) jittered(delay time.Duration) time.Duration {
+	if d.jitter == 0 || d.jitterRand == nil {
+		return delay
 	}
-	matchedItems := make([]*archiveItem, 0)
-	for i := range items {
-		if !rx.MatchString(items[i].Name) {
-			continue
-		}
-		matchedItems = append(matchedItems, items[i])
-	}
-	discardItems := make([]*archiveItem, 0)
-	currentIndex := 0
-	now := time.Now()
-	twoYearsAgo := time.Date(now.Year()-2, now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-	twoMonthsAgo := time.Date(now.Year(), now.Month()-2, now.Day(), 0, 0, 0, 0, time.UTC)
-	for currentIndex < len(matchedItems) {
-		if alreadyDeletedMap[matchedItems[currentIndex].Name] {
-			fmt.Println("gone   ", matchedItems[currentIndex].Name)
-			currentIndex++
-			continue
+	d.mu.Lock()
+	f := d.jitterRand.Float64()
+	d.mu.Unlock()
+	return time.Duration(float64(delay) * (1 + d.jitter*(2*f-1)))
+}
+
+// fatal records that archives failed to delete, logs the run summary and
+// exits.
+func (d *deleter) fatal(archives []string, err error) {
+	d.stats.addErrors(int64(len(archives)))
+	d.setOutcome(archives, actionFailed)
+	d.recordAudit(auditDelete, archives, "failed", err)
+	slog.Info("summary", "archives", d.stats)
+	fatal("could not delete archives", "archives", archives, "err", err)
+}
+
+// failed returns the archives that d couldn't delete, sorted by name.
+func (d *deleter) failed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0)
+	for name, outcome := range d.outcomes {
+		if outcome == actionFailed {
+			names = append(names, name)
 		}
-		dryRunPrint(*dryRun, "keep", matchedItems[currentIndex].String())
-		periodStart := matchedItems[currentIndex].Date
-		currentIndex++
-		// two years or more ago, one archive per month
-		// between two years and two months, one per week
-		// sooner than two months, all
-		var periodEnd time.Time
-		if periodStart.Add(30 * 24 * time.Hour).Before(twoYearsAgo) {
-			periodEnd = periodStart.Add(30 * 24 * time.Hour)
-		} else if periodStart.Add(7 * 24 * time.Hour).Before(twoMonthsAgo) {
-			periodEnd = periodStart.Add(7 * 24 * time.Hour)
-		} else {
-			currentIndex++
-			continue
+	}
+	sort.Strings(names)
+	return names
+}
+
+// untried returns how many of items d never tried to delete.
+func (d *deleter) untried(items []*archiveItem) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, item := range items {
+		if _, ok := d.outcomes[item.Name]; !ok {
+			n++
 		}
-		for currentIndex < len(matchedItems) {
-			if alreadyDeletedMap[matchedItems[currentIndex].Name] {
-				fmt.Println("gone   ", matchedItems[currentIndex].Name)
-				currentIndex++
+	}
+	return n
+}
+
+// stopped reports whether d.stop has been closed.
+func (d *deleter) stopped() bool {
+	select {
+	case <-d.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// recordAudit records what happened to archives in d.audit, exiting if it
+// can't.
+func (d *deleter) recordAudit(action string, archives []string, result string, err error) {
+	if d.simulated && result == "deleted" {
+		result = "simulated"
+	}
+	d.events.sendResults(archives, result, err)
+	if err := d.audit.record(action, archives, result, err); err != nil {
+		fatal("could not write -audit-log", "archives", archives, "err", err)
+	}
+}
+
+func (d *deleter) printGone(name string) {
+	if !d.quietGone {
+		fmt.Println("gone   ", name)
+	}
+}
+
+// deleteOne deletes the named archive. Unlike a failed batch, a failure here
+// doesn't stop the run; it's counted in d.stats and main exits non-zero at
+// the end.
+func (d *deleter) deleteOne(ctx context.Context, name string) {
+	err := d.deleteArchives(ctx, []string{name})
+	if err != nil && err != errAlreadyDeleted {
+		d.stats.addErrors(1)
+		d.setOutcome([]string{name}, actionFailed)
+		d.recordAudit(auditDeleteOne, []string{name}, "failed", err)
+		slog.Error("could not delete archive", "archive", name, "err", err)
+		return
+	}
+	if err := d.deleted.record([]string{name}); err != nil {
+		fatal("could not record deleted archive", "archive", name, "err", err)
+	}
+	if err == errAlreadyDeleted {
+		d.printGone(name)
+		d.stats.addGone(1)
+		d.setOutcome([]string{name}, actionGone)
+		d.recordAudit(auditDeleteOne, []string{name}, "gone", nil)
+		return
+	}
+	d.stats.addDiscarded(1)
+	d.setOutcome([]string{name}, actionDiscard)
+	d.recordAudit(auditDeleteOne, []string{name}, "deleted", nil)
+}
+
+// batches sends the archives that plan discards to the returned channel,
+// d.batchSize at a time, closing it once every archive has been sent. Batches
+// are cut short if their arguments would add up to more than maxArgBytes, or,
+// if d.groupTarsnap is set, at the end of each group.
+func (d *deleter) batches(plan []decision) <-chan []string {
+	if len(d.groupTarsnap) > 0 {
+		plan = slices.Clone(plan)
+		sort.SliceStable(plan, func(i, j int) bool {
+			return plan[i].Item.Group < plan[j].Item.Group
+		})
+	}
+	d.groups = make(map[string]string)
+	for i := range plan {
+		d.groups[plan[i].Item.Name] = plan[i].Item.Group
+	}
+	ch := make(chan []string)
+	go func() {
+		defer close(ch)
+		archives := make([]string, 0, d.batchSize)
+		size := 0
+		for i := range plan {
+			if plan[i].Action != actionDiscard {
 				continue
 			}
-			if matchedItems[currentIndex].Date.Before(periodEnd) {
-				dryRunPrint(*dryRun, "discard", matchedItems[currentIndex].String())
-				discardItems = append(discardItems, matchedItems[currentIndex])
-				currentIndex++
+			name := plan[i].Item.Name
+			if d.alreadyDeleted[name] {
+				d.printGone(name)
+				d.stats.addGone(1)
+				d.setOutcome([]string{name}, actionGone)
+				d.recordAudit(auditSkip, []string{name}, "gone", nil)
+				d.progress.add(1)
 				continue
 			}
-			// keep the next item, which is outside the period.
-			break
+			// "-f", name and their terminating NULs
+			n := len(name) + 4
+			newGroup := len(d.groupTarsnap) > 0 && len(archives) > 0 && d.groups[archives[0]] != plan[i].Item.Group
+			if len(archives) > 0 && (size+n > maxArgBytes || newGroup) {
+				select {
+				case ch <- archives:
+				case <-d.stop:
+					return
+				}
+				archives = make([]string, 0, d.batchSize)
+				size = 0
+			}
+			archives = append(archives, name)
+			size += n
+			if len(archives) == d.batchSize {
+				select {
+				case ch <- archives:
+				case <-d.stop:
+					return
+				}
+				archives = make([]string, 0, d.batchSize)
+				size = 0
+			}
 		}
+		if len(archives) > 0 {
+			select {
+			case ch <- archives:
+			case <-d.stop:
+			}
+		}
+	}()
+	return ch
+}
+
+// pause waits for d.delay, and reports whether the run should carry on
+// afterwards: it returns false early if the run is stopped or ctx is done.
+// run calls it once a batch has a free slot, so the wait doesn't overlap
+// the batch before it when there's only one.
+func (d *deleter) pause(ctx context.Context) bool {
+	if d.delay <= 0 {
+		return true
 	}
-	if *dryRun {
-		return
+	t := time.NewTimer(d.delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-d.stop:
+		return false
+	case <-ctx.Done():
+		return false
 	}
+}
+
+// run deletes each batch of archives received from batches, as soon as the
+// semaphore allows. If a batch fails because one of its archives is already
+// gone, the archives in the batch are deleted one by one instead.
+func (d *deleter) run(ctx context.Context, cancel context.CancelFunc, batches <-chan []string) {
 	var wg sync.WaitGroup
-	s := semaphore.New(concurrency)
-	for i := 0; i < len(discardItems); {
-		archives := make([]string, 0)
-		initialIndex := i
-		for j := initialIndex; j < initialIndex+*batchSize && j < len(discardItems); j++ {
-			name := discardItems[j].Name
-			if alreadyDeletedMap[name] {
-				fmt.Println("gone   ", name)
-				continue
-			}
-			archives = append(archives, name)
-			i++
-		}
+	s := semaphore.New(max(d.concurrency, 1))
+	first := true
+	for archives := range batches {
 		s.Acquire()
+		if !first && !d.pause(ctx) {
+			s.Release()
+			break
+		}
+		first = false
+		if d.stopped() {
+			s.Release()
+			break
+		}
 		wg.Add(1)
-		go func(archives_ []string) {
+		go func(batch []string) {
 			defer s.Release()
 			defer wg.Done()
-			if err := deleteArchives(ctx, archives); err != nil {
+			defer d.progress.add(len(batch))
+			defer d.lockGroup(batch)()
+			if d.sequential {
+				for i := range batch {
+					d.deleteOne(ctx, batch[i])
+				}
+				slog.Info("progress", "done", d.stats.discarded.Load()+d.stats.gone.Load()+d.stats.errors.Load(), "total", d.total)
+				return
+			}
+			if err := d.deleteArchives(ctx, batch); err != nil {
 				if err == errAlreadyDeleted {
 					// delete one by one
-					for i := range archives {
-						indivErr := deleteArchives(ctx, []string{archives[i]})
-						if indivErr != nil && indivErr != errAlreadyDeleted {
-							log.Fatal(indivErr)
-						}
-						if indivErr == errAlreadyDeleted {
-							fmt.Println("gone   ", archives[i])
-							continue
-						}
+					for i := range batch {
+						d.deleteOne(ctx, batch[i])
 					}
-				} else if err != nil {
+				} else if d.continueOnError {
+					d.stats.addErrors(int64(len(batch)))
+					d.setOutcome(batch, actionFailed)
+					d.recordAudit(auditDelete, batch, "failed", err)
+					slog.Error("could not delete archives", "archives", batch, "err", err)
+				} else {
 					cancel()
-					log.Fatal(err)
+					d.fatal(batch, err)
 				}
+				return
+			}
+			d.stats.addDiscarded(int64(len(batch)))
+			d.setOutcome(batch, actionDiscard)
+			d.recordAudit(auditDelete, batch, "deleted", nil)
+			if err := d.deleted.record(batch); err != nil {
+				fatal("could not record deleted archives", "archives", batch, "err", err)
 			}
 		}(archives)
 	}
 	wg.Wait()
 }
+
+// selectArchives returns the archives in items that -host, -archive-regex and
+// the time window match, setting each one's group. Those matching
+// -exclude-regex are returned in excluded, and those with no date in undated,
+// instead of in matched.
+func (o *options) selectArchives(items []*archiveItem) (matched, excluded, undated []*archiveItem) {
+	matched = make([]*archiveItem, 0)
+	excluded = make([]*archiveItem, 0)
+	for i := range items {
+		if o.host != "" && !strings.HasPrefix(items[i].Name, o.host+"-") {
+			continue
+		}
+		group, ok := matchGroup(o.rxs, items[i].Name)
+		if !ok {
+			continue
+		}
+		items[i].Group = group
+		if o.groupByPrefix {
+			items[i].Group = prefixGroup(items[i].Name, o.prefixSeparator)
+		}
+		if !items[i].undated() && !inWindow(items[i].Date, o.afterTime, o.beforeTime) {
+			continue
+		}
+		if matchesAny(o.excludeRxs, items[i].Name) {
+			excluded = append(excluded, items[i])
+			continue
+		}
+		if items[i].undated() {
+			undated = append(undated, items[i])
+			continue
+		}
+		matched = append(matched, items[i])
+	}
+	return matched, excluded, undated
+}
+
+// planArchives decides what to do with the matched archives, using pol or
+// -delete-all-matching, then applies -keep-newest-per-group and -target-free.
+// The excluded and undated archives are added to the plan as kept.
+func (o *options) planArchives(pol Policy, matched, excluded, undated []*archiveItem, alreadyDeleted map[string]bool) []decision {
+	var plan []decision
+	if o.deleteAllMatching {
+		plan = discardAll(matched, alreadyDeleted)
+		pol.keepMinAge(plan, o.now)
+		if o.dryRun {
+			names := make([]string, 0)
+			for _, item := range discards(plan) {
+				names = append(names, item.Name)
+			}
+			slog.Warn("-delete-all-matching: EVERY MATCHED ARCHIVE OLDER THAN -min-age WOULD BE DELETED", "count", len(names), "archives", names)
+		}
+	} else {
+		plan = pol.decide(matched, o.now, alreadyDeleted)
+	}
+	if o.keepNewest {
+		keepNewestPerGroup(plan)
+	}
+	if o.targetFree > 0 {
+		selected := discardLargestUntil(plan, o.targetFree)
+		if selected < o.targetFree {
+			slog.Warn("the retention policy doesn't allow deleting enough to reach -target-free", "target_bytes", o.targetFree, "max_bytes", selected)
+		} else {
+			slog.Info("selected the largest archives for -target-free", "target_bytes", o.targetFree, "max_bytes", selected, "archives", len(discards(plan)))
+		}
+	}
+	if len(excluded) > 0 || len(undated) > 0 {
+		for i := range excluded {
+			plan = append(plan, decision{excluded[i], actionExcluded, ""})
+		}
+		for i := range undated {
+			plan = append(plan, decision{undated[i], actionKeep, "undated"})
+		}
+		sortByDate(plan)
+	}
+	return plan
+}
+
+// printList prints the archives for -list-only in -format.
+func (o *options) printList(w io.Writer, listed []*archiveItem) error {
+	switch o.format {
+	case "json":
+		return writeJSONList(w, listed)
+	case "csv":
+		return writeCSVList(w, listed)
+	}
+	for i := range listed {
+		fmt.Fprintln(w, listed[i].String())
+	}
+	return nil
+}
+
+// printPlan prints the plan in -format before anything is deleted. A real run
+// only prints it as text here: it prints CSV with the outcomes once deletion
+// finishes, and doesn't print JSON.
+func (o *options) printPlan(w io.Writer, plan []decision) error {
+	switch o.format {
+	case "text":
+		if o.quietGone {
+			plan = withoutGone(plan)
+		}
+		writeTextPlan(w, plan, o.dryRun)
+	case "json":
+		if o.dryRun {
+			return writeJSONPlan(w, plan)
+		}
+	case "csv":
+		if o.dryRun {
+			return writeCSVPlan(w, plan)
+		}
+	}
+	return nil
+}
+
+// readAlreadyDeleted reads -already-deleted-file, if it's set, returning the
+// names in it as a set and in the order they're listed.
+func (o *options) readAlreadyDeleted() (map[string]bool, []string, error) {
+	m := make(map[string]bool)
+	var names []string
+	if o.alreadyDeleted == "" {
+		return m, names, nil
+	}
+	data, err := os.ReadFile(o.alreadyDeleted)
+	// -append-deleted will create the file on the first run.
+	if err != nil && !(os.IsNotExist(err) && (o.appendDeleted || o.markDeleted != "")) {
+		return nil, nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		// The file may have been edited on Windows.
+		if line := strings.TrimSuffix(lines[i], "\r"); line != "" && !m[line] {
+			m[line] = true
+			names = append(names, line)
+		}
+	}
+	return m, names, nil
+}
+
+// readListing reads the archive listing from -file, the -cache-list cache or
+// tarsnap, and parses it. The lines that -skip-unparseable skipped are
+// returned with the archives.
+func (o *options) readListing(ctx context.Context, tarsnap tarsnapCmd, cacheFile string) ([]*archiveItem, []string, error) {
+	var archives io.Reader
+	if o.file != "" {
+		f, err := openListing(o.file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not open -file: %w", err)
+		}
+		defer f.Close()
+		archives = f
+	} else if data, ok := readListingCache(cacheFile, o.cacheTTL, time.Now()); ok {
+		slog.Info("using cached archive listing", "file", cacheFile)
+		archives = bytes.NewReader(data)
+	} else {
+		r, err := tarsnap.ListArchives(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not list archives: %w", err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not list archives: %w", err)
+		}
+		archives = bytes.NewReader(data)
+		if cacheFile != "" {
+			if err := writeListingCache(cacheFile, data); err != nil {
+				slog.Warn("could not cache archive listing", "err", err)
+			} else {
+				slog.Info("cached archive listing", "file", cacheFile)
+			}
+		} else if o.saveListing {
+			tmp, err := os.CreateTemp("", "tarsnap-old-archives-")
+			if err == nil {
+				tmp.Write(data)
+				slog.Info("wrote archive listing", "file", tmp.Name())
+				tmp.Close()
+			}
+		}
+	}
+	counter := &countingReader{r: archives}
+	// tarsnap is always run with -v, so only -file can hold a listing made
+	// without it.
+	items, unparseable, err := readArchiveItems(counter, parseOptions{skipBad: o.skipUnparseable, nameDateFormat: o.nameDateFormat, verbose: o.file == ""})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse archive listing: %w", err)
+	}
+	items, dupes := dedupe(items)
+	if dupes > 0 {
+		slog.Info("collapsed archives listed more than once", "duplicates", dupes)
+	}
+	if len(items) == 0 {
+		if counter.n > 0 {
+			return nil, nil, fmt.Errorf("archive listing was not empty, but no archives could be parsed from its %d bytes", counter.n)
+		}
+		slog.Info("no archives found")
+	}
+	return items, unparseable, nil
+}
+
+// reconcileListing lists the archives from tarsnap, warns about differences
+// from items, which were read from -file, and returns the names of those in
+// items that tarsnap doesn't list.
+func (o *options) reconcileListing(ctx context.Context, tarsnap tarsnapCmd, items []*archiveItem) (map[string]bool, error) {
+	r, err := tarsnap.ListArchives(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list archives for -reconcile: %w", err)
+	}
+	live, _, err := readArchiveItems(r, parseOptions{skipBad: true, nameDateFormat: o.nameDateFormat, verbose: true})
+	if err != nil {
+		return nil, fmt.Errorf("could not parse archive listing for -reconcile: %w", err)
+	}
+	notLive, notInFile := compareListings(items, live)
+	if len(notLive) > 0 {
+		slog.Warn("-file lists archives that tarsnap doesn't", "count", len(notLive), "archives", sortedKeys(notLive))
+	}
+	if len(notInFile) > 0 {
+		slog.Warn("tarsnap lists archives that -file doesn't", "count", len(notInFile), "archives", notInFile)
+	}
+	if len(notLive) == 0 && len(notInFile) == 0 {
+		slog.Info("-file matches the live listing", "archives", len(items))
+	}
+	return notLive, nil
+}
+
+// newDeleter returns a deleter for the archives in a real run, opening
+// -already-deleted-file for -append-deleted and -audit-log. total is the
+// number of archives it will delete.
+func (o *options) newDeleter(tarsnap tarsnapCmd, stats *runStats, events *planStream, alreadyDeleted map[string]bool, total int) (*deleter, error) {
+	var deleted *deletedLog
+	if o.appendDeleted {
+		var err error
+		deleted, err = openDeletedLog(o.alreadyDeleted)
+		if err != nil {
+			return nil, fmt.Errorf("could not open -already-deleted-file: %w", err)
+		}
+	}
+	var audit *auditLog
+	if o.auditLogFile != "" {
+		var err error
+		audit, err = openAuditLog(o.auditLogFile)
+		if err != nil {
+			deleted.Close()
+			return nil, fmt.Errorf("could not open -audit-log: %w", err)
+		}
+	}
+	d := &deleter{
+		batchSize:       o.batchSize,
+		alreadyDeleted:  alreadyDeleted,
+		deleted:         deleted,
+		audit:           audit,
+		simulated:       o.noExec,
+		events:          events,
+		stats:           stats,
+		maxRetries:      o.maxRetries,
+		retryDelay:      o.retryDelay,
+		jitter:          o.retryJitter,
+		sequential:      o.sequential,
+		concurrency:     o.concurrency,
+		delay:           o.delay,
+		quietGone:       o.quietGone,
+		continueOnError: o.onError == "continue",
+		total:           total,
+	}
+	if o.sequential {
+		d.batchSize = 1
+	}
+	if seed := o.retryJitterSeed; seed != 0 {
+		d.jitterRand = rand.New(rand.NewSource(seed))
+	} else {
+		d.jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if o.showProgress {
+		d.progress = newProgress(os.Stderr, isTerminal(os.Stderr), total)
+	}
+	// tarsnap runs in its own process group so that an interrupt doesn't
+	// reach it; see run.
+	tarsnap.ownProcessGroup = true
+	if o.printStats {
+		tarsnap.freed = &stats.freed
+	}
+	d.tarsnap = tarsnap
+	if o.noExec {
+		d.tarsnap = noExecTarsnap{tarsnap, o.simulateLatency}
+	}
+	if len(o.groupKeyfileMap)+len(o.groupCachedirMap) > 0 {
+		d.groupTarsnap = make(map[string]Tarsnap)
+		for _, paths := range []map[string]string{o.groupKeyfileMap, o.groupCachedirMap} {
+			for group := range paths {
+				kf, ok := o.groupKeyfileMap[group]
+				if !ok {
+					kf = o.keyfile
+				}
+				cd, ok := o.groupCachedirMap[group]
+				if !ok {
+					cd = o.cachedir
+				}
+				t := newTarsnapCmd(o.tarsnapBin, o.configfile, kf, cd)
+				t.verbose, t.timeout, t.ownProcessGroup, t.freed = tarsnap.verbose, tarsnap.timeout, true, tarsnap.freed
+				d.groupTarsnap[group] = t
+				if o.noExec {
+					d.groupTarsnap[group] = noExecTarsnap{t, o.simulateLatency}
+				}
+			}
+		}
+	}
+	return d, nil
+}
+
+// beforeExit, if set, is called with the error message when fatal exits.
+var beforeExit func(msg string)
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	if beforeExit != nil {
+		beforeExit(msg)
+	}
+	os.Exit(1)
+}
+
+func main() {
+	cmd, args, err := parseCommand(os.Args[1:])
+	if err != nil {
+		fatal(err.Error())
+	}
+	if cmd != nil {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0]+" "+cmd.name, flag.ExitOnError)
+		flag.CommandLine.Usage = cmd.usage
+	} else {
+		flag.Usage = func() {
+			printCommands(flag.CommandLine)
+			usage()
+		}
+	}
+	o := newOptions(flag.CommandLine)
+	flag.CommandLine.Parse(args)
+	if cmd != nil {
+		if err := cmd.apply(flag.CommandLine); err != nil {
+			fatal(err.Error())
+		}
+	}
+	os.Exit(run(cmd, o))
+}
+
+// run runs cmd, which is nil if none was given, with the flags in o, and
+// returns the exit status. It calls fatal for errors that end the run early.
+func run(cmd *command, o *options) int {
+	start := time.Now()
+	stats := new(runStats)
+	var d *deleter
+	if o.summaryOut != "" {
+		var once sync.Once
+		write := func(msg string) {
+			once.Do(func() {
+				s := newRunSummary(stats, start, o.dryRun, msg)
+				if d != nil {
+					s.FailedArchives = d.failed()
+				}
+				if err := writeRunSummary(o.summaryOut, s); err != nil {
+					slog.Error("could not write -summary-out", "err", err)
+				}
+			})
+		}
+		beforeExit = write
+		defer write("")
+	}
+	// Run before -config, which doesn't override flags that are already set.
+	if err := applyEnv(o.fs); err != nil {
+		fatal("could not read flags from the environment", "err", err)
+	}
+	if o.configFile != "" {
+		c, err := readConfig(o.configFile)
+		if err != nil {
+			fatal("could not read -config", "err", err)
+		}
+		if err := c.apply(o.fs); err != nil {
+			fatal("could not apply -config", "err", err)
+		}
+	}
+	switch o.logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	default:
+		fatal("unknown -log-format, want text or json", "log_format", o.logFormat)
+	}
+	if cmd == nil {
+		slog.Warn("running without a command is deprecated, and won't work in the next release. " +
+			"Use plan instead of -dry-run=true, delete instead of -dry-run=false, or list instead of -list-only")
+	}
+	if err := o.validate(); err != nil {
+		fatal(err.Error())
+	}
+	// Check for tarsnap before doing any work that would need it. A plan
+	// or a list of names to delete replaces the listing.
+	needListing := o.file == "" && o.executePlan == "" && o.deleteNamesFile == ""
+	if needListing || (!o.dryRun && (!o.noExec || o.verify)) || o.sizes || o.reconcile {
+		path, err := exec.LookPath(o.tarsnapBin)
+		if err != nil {
+			hint := "install tarsnap (see https://www.tarsnap.com/download.html), or set -tarsnap-bin to its path"
+			if needListing && o.dryRun {
+				hint += ". To plan without tarsnap, pass a saved listing with -file"
+			}
+			fatal("could not find the tarsnap binary: "+hint, "tarsnap_bin", o.tarsnapBin, "err", err)
+		}
+		o.tarsnapBin = path
+	}
+	if o.nowFlag != "" {
+		slog.Warn("planning as if it were -now, not the current time", "now", o.now, "dry_run", o.dryRun)
+	}
+	now := o.now
+	pol, err := o.policy()
+	if err != nil {
+		fatal(err.Error())
+	}
+	if o.verbose {
+		pol.logCutoffs(now, "")
+		for _, group := range sortedKeys(pol.Groups) {
+			pol.Groups[group].logCutoffs(now, group)
+		}
+	}
+	tarsnap := newTarsnapCmd(o.tarsnapBin, o.configfile, o.keyfile, o.cachedir)
+	tarsnap.verbose = o.verbose
+	tarsnap.timeout = o.timeout
+	alreadyDeletedMap, alreadyDeletedNames, err := o.readAlreadyDeleted()
+	if err != nil {
+		fatal("could not read -already-deleted-file", "err", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var cacheFile string
+	var unparseable []string
+	reportUnparseable := func() {
+		if len(unparseable) > 0 {
+			slog.Warn("skipped lines that could not be parsed", "count", len(unparseable), "lines", unparseable)
+		}
+	}
+	var plan []decision
+	// with -reconcile, archives in -file that tarsnap doesn't list
+	var notLive map[string]bool
+	if o.executePlan != "" {
+		f, err := os.Open(o.executePlan)
+		if err != nil {
+			fatal("could not open -execute-plan", "err", err)
+		}
+		plan, err = readExecutablePlan(f)
+		f.Close()
+		if err != nil {
+			fatal("refusing to execute a malformed plan", "file", o.executePlan, "err", err)
+		}
+		slog.Info("executing plan", "file", o.executePlan, "discard", len(discards(plan)))
+	} else if o.deleteNamesFile != "" {
+		f, err := os.Open(o.deleteNamesFile)
+		if err != nil {
+			fatal("could not open -delete-names-file", "err", err)
+		}
+		items, err := readNames(f)
+		f.Close()
+		if err != nil {
+			fatal("could not read -delete-names-file", "file", o.deleteNamesFile, "err", err)
+		}
+		plan = discardAll(items, alreadyDeletedMap)
+		for i := range plan {
+			plan[i].Reason = "named"
+		}
+		slog.Info("deleting archives named in file", "file", o.deleteNamesFile, "discard", len(discards(plan)))
+	} else {
+		if o.cacheList && o.file == "" {
+			cacheFile, err = listingCachePath(tarsnap)
+			if err != nil {
+				fatal("could not find a directory for -cache-list", "err", err)
+			}
+		}
+		var items []*archiveItem
+		items, unparseable, err = o.readListing(ctx, tarsnap, cacheFile)
+		if err != nil {
+			fatal(err.Error())
+		}
+		if o.reconcile {
+			notLive, err = o.reconcileListing(ctx, tarsnap, items)
+			if err != nil {
+				fatal(err.Error())
+			}
+		}
+		setLocation(items, pol.Location)
+		if o.verbose {
+			// An archive that seems much older or newer than it should
+			// points to the wrong -timezone.
+			for i := len(items) - 1; i >= 0; i-- {
+				if !items[i].undated() {
+					slog.Info("newest archive", "archive", items[i].Name, "date", items[i].Date, "age", now.Sub(items[i].Date).Round(time.Minute))
+					break
+				}
+			}
+		}
+		matchedItems, excludedItems, undatedItems := o.selectArchives(items)
+		if o.failOnEmpty && len(matchedItems) == 0 && len(undatedItems) == 0 {
+			fatal("no archives matched, exiting because of -fail-on-empty-match", "archives", len(items), "excluded", len(excludedItems))
+		}
+		if len(undatedItems) > 0 {
+			slog.Warn("keeping archives with no date; list archives with -v, or set -name-date-format, to apply retention to them", "count", len(undatedItems))
+		}
+		if len(pol.Groups) > 0 {
+			seen := make(map[string]bool)
+			for i := range matchedItems {
+				seen[matchedItems[i].Group] = true
+			}
+			for _, group := range sortedKeys(pol.Groups) {
+				if seen[group] {
+					continue
+				}
+				// A real run shouldn't carry on with an override that
+				// was probably meant for a group with another name.
+				if !o.dryRun {
+					fatal("no matched archives are in the group named by -group-policy", "group", group)
+				}
+				slog.Warn("no matched archives are in the group named by -group-policy", "group", group)
+			}
+		}
+		if o.sizes {
+			if err := fetchSizes(ctx, tarsnap, matchedItems); err != nil {
+				fatal("could not fetch archive sizes", "err", err)
+			}
+		}
+		if o.listOnly {
+			listed := append(append(append(make([]*archiveItem, 0, len(matchedItems)+len(excludedItems)+len(undatedItems)), matchedItems...), excludedItems...), undatedItems...)
+			sort.SliceStable(listed, func(i, j int) bool {
+				return listed[i].Date.Before(listed[j].Date)
+			})
+			if err := o.printList(os.Stdout, listed); err != nil {
+				fatal("could not write archive list", "err", err)
+			}
+			reportUnparseable()
+			return 0
+		}
+		if o.strict {
+			if _, future := splitFuture(matchedItems, now); len(future) > 0 {
+				fatal("archives are dated in the future", "count", len(future), "first", future[0].Name, "date", future[0].Date)
+			}
+		}
+		plan = o.planArchives(pol, matchedItems, excludedItems, undatedItems, alreadyDeletedMap)
+	}
+	if o.countOnly {
+		matched := 0
+		for i := range plan {
+			if plan[i].Action != actionExcluded {
+				matched++
+			}
+		}
+		fmt.Println(matched, len(discards(plan)))
+		return 0
+	}
+	if o.metricsAddr != "" {
+		stats.metrics = newMetrics()
+		stop, err := stats.metrics.serve(o.metricsAddr)
+		if err != nil {
+			fatal("could not serve metrics", "err", err)
+		}
+		defer stop()
+	}
+	for i := range plan {
+		switch plan[i].Action {
+		case actionKeep, actionExcluded:
+			stats.addKept(1)
+		case actionGone:
+			stats.addGone(1)
+		case actionDiscard:
+			if o.dryRun {
+				stats.addDiscarded(1)
+			}
+		}
+	}
+	var events *planStream
+	if network, addr, ok := planStreamAddr(o.planOut); ok {
+		events, err = dialPlanStream(network, addr)
+		if err != nil {
+			fatal("could not connect to -plan-out", "network", network, "addr", addr, "err", err)
+		}
+		defer events.Close()
+		events.sendPlan(plan)
+	}
+	printed := plan
+	if o.previousPlan != "" {
+		f, err := os.Open(o.previousPlan)
+		if err != nil {
+			fatal("could not open -previous-plan", "err", err)
+		}
+		prev, err := readJSONPlan(f)
+		f.Close()
+		if err != nil {
+			fatal("could not read -previous-plan", "file", o.previousPlan, "err", err)
+		}
+		printed = changedSince(plan, prev)
+	}
+	printed = sortedForDisplay(printed, o.sortOrder)
+	if err := o.printPlan(os.Stdout, printed); err != nil {
+		fatal("could not write plan", "err", err)
+	}
+	if o.calendar {
+		writeCalendar(os.Stdout, plan)
+	}
+	discardItems := discards(plan)
+	if o.maxDelete > 0 && len(discardItems) > o.maxDelete {
+		switch {
+		case o.dryRun:
+			slog.Warn("plan discards more archives than -max-delete allows", "discard", len(discardItems), "max_delete", o.maxDelete)
+		case !o.force:
+			fatal("refusing to delete more archives than -max-delete allows, use -force to delete them anyway", "discard", len(discardItems), "max_delete", o.maxDelete)
+		}
+	}
+	if stale := namesIn(discardItems, notLive); len(stale) > 0 {
+		switch {
+		case o.dryRun:
+			slog.Warn("plan discards archives that aren't in the live listing", "count", len(stale), "archives", stale)
+		case !o.force:
+			fatal("refusing to delete archives that aren't in the live listing, use -force to try anyway", "count", len(stale), "archives", stale)
+		}
+	}
+	if o.sizes {
+		slog.Info("reclaimable space", "archives", len(discardItems), "max_bytes", totalSize(discardItems))
+	}
+	if o.dryRun {
+		if o.planOut != "" && events == nil {
+			if err := writePlanFile(o.planOut, o.format, plan); err != nil {
+				fatal("could not write -plan-out", "err", err)
+			}
+		}
+		if o.markDeleted != "" {
+			if err := writeMarkedDeleted(o.markDeleted, alreadyDeletedNames, discardItems); err != nil {
+				fatal("could not write -dry-run-mark-deleted", "err", err)
+			}
+		}
+		reportUnparseable()
+		slog.Info("summary", "archives", stats)
+		return 0
+	}
+	if o.concurrency > 1 {
+		if err := checkConcurrentGroups(discardItems, o.groupKeyfileMap, o.groupCachedirMap); err != nil {
+			fatal("refusing to run tarsnap commands concurrently with one key and cache directory", "concurrency", o.concurrency, "err", err)
+		}
+	}
+	if o.interactive && !isTerminal(os.Stdin) {
+		slog.Warn("ignoring -interactive because stdin is not a terminal")
+		o.interactive = false
+	}
+	if o.interactive && len(discardItems) > 0 {
+		approved := approveEach(os.Stdin, os.Stderr, discardItems)
+		for i := range plan {
+			if plan[i].Action == actionDiscard && !approved[plan[i].Item.Name] {
+				plan[i].Action = actionKeep
+				plan[i].Reason = "not-approved"
+				stats.addKept(1)
+			}
+		}
+		discardItems = discards(plan)
+		if len(discardItems) == 0 {
+			slog.Info("no archives approved, none deleted")
+			return 0
+		}
+	} else if !o.yes && len(discardItems) > 0 {
+		if !isTerminal(os.Stdin) {
+			fatal("refusing to delete archives without -yes when stdin is not a terminal")
+		}
+		if !confirm(os.Stdin, os.Stderr, fmt.Sprintf("Delete %d archives?", len(discardItems))) {
+			slog.Info("aborting, no archives deleted")
+			return 0
+		}
+	}
+	if o.verify {
+		slog.Info("checking archive set with tarsnap --fsck")
+		if err := fsck(ctx, tarsnap); err != nil {
+			fatal("refusing to delete archives, -verify failed", "err", err)
+		}
+	}
+	d, err = o.newDeleter(tarsnap, stats, events, alreadyDeletedMap, len(discardItems))
+	if err != nil {
+		fatal(err.Error())
+	}
+	// The first interrupt stops new batches from starting, and lets the
+	// ones in flight finish and be recorded; tarsnap runs in its own process
+	// group so the interrupt doesn't reach it. A second interrupt exits
+	// right away.
+	stop := make(chan struct{})
+	d.stop = stop
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		slog.Warn("interrupted, waiting for deletes in progress to finish. Interrupt again to exit immediately")
+		close(stop)
+		<-sigs
+		cancel()
+		fatal("interrupted again, exiting")
+	}()
+	// The hook runs once, when the run ends or when fatal exits partway
+	// through it, so it hears about partial failures too.
+	var hookOnce sync.Once
+	hookFailed := false
+	runHook := func(ctx context.Context) {
+		hookOnce.Do(func() {
+			if err := runPostHook(ctx, o.postHook, stats, o.noExec); err != nil {
+				slog.Error("post hook failed", "command", o.postHook, "err", err)
+				hookFailed = o.postHookRequired
+			}
+		})
+	}
+	if o.postHook != "" {
+		next := beforeExit
+		beforeExit = func(msg string) {
+			// A failed batch cancels ctx to stop the others.
+			runHook(context.WithoutCancel(ctx))
+			if next != nil {
+				next(msg)
+			}
+		}
+	}
+	// Like the hook, -plan-out is written once, when the run ends or when
+	// fatal exits partway through it. batches may still be reading plan
+	// then, so the outcomes go on a copy.
+	var planOnce sync.Once
+	var planErr error
+	writePlanOut := func() error {
+		planOnce.Do(func() {
+			done := slices.Clone(plan)
+			d.applyOutcomes(done)
+			planErr = writePlanFile(o.planOut, o.format, done)
+		})
+		return planErr
+	}
+	if o.planOut != "" && events == nil {
+		next := beforeExit
+		beforeExit = func(msg string) {
+			if err := writePlanOut(); err != nil {
+				slog.Error("could not write -plan-out", "err", err)
+			}
+			if next != nil {
+				next(msg)
+			}
+		}
+	}
+	d.run(ctx, cancel, d.batches(plan))
+	signal.Stop(sigs)
+	d.progress.finish()
+	if cacheFile != "" {
+		// The cached listing still names the archives we just deleted.
+		if err := os.Remove(cacheFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("could not remove cached archive listing", "file", cacheFile, "err", err)
+		}
+	}
+	if err := d.deleted.Close(); err != nil {
+		fatal("could not close -already-deleted-file", "err", err)
+	}
+	if err := d.audit.Close(); err != nil {
+		fatal("could not close -audit-log", "err", err)
+	}
+	d.applyOutcomes(plan)
+	switch o.format {
+	case "text":
+		if o.printKept {
+			writeTextPlan(os.Stdout, keptDecisions(printed), true)
+		}
+	case "json":
+		if o.printKept {
+			if err := writeJSONPlan(os.Stdout, keptDecisions(printed)); err != nil {
+				fatal("could not write kept archives", "err", err)
+			}
+		}
+	case "csv":
+		d.applyOutcomes(printed)
+		if err := writeCSVPlan(os.Stdout, printed); err != nil {
+			fatal("could not write plan", "err", err)
+		}
+	}
+	if o.planOut != "" && events == nil {
+		if err := writePlanOut(); err != nil {
+			fatal("could not write -plan-out", "err", err)
+		}
+	}
+	reportUnparseable()
+	if names := d.failed(); len(names) > 0 {
+		slog.Error("some archives could not be deleted", "count", len(names), "archives", names)
+	}
+	slog.Info("summary", "archives", stats)
+	if o.targetFree > 0 && o.printStats {
+		slog.Info("space freed for -target-free", "target_bytes", o.targetFree, "freed_bytes", stats.freed.Load())
+	}
+	if o.postHook != "" {
+		runHook(ctx)
+	}
+	failed := stats.errors.Load() > 0 || hookFailed
+	if d.stopped() {
+		slog.Warn("stopped before every archive was deleted", "remaining", d.untried(discardItems))
+		if beforeExit != nil {
+			beforeExit("interrupted")
+		}
+		return 130
+	}
+	if failed {
+		if beforeExit != nil {
+			beforeExit("")
+		}
+		return 1
+	}
+	return 0
+}
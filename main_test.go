@@ -1,5 +1,21 @@
 package main
 
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
 //buf.WriteString(`hostname-2018-02-01_18-12-53	2018-02-01 18:12:53
 //hostname-2018-01-24_15-19-42	2018-01-24 15:19:42
 //hostname-2018-01-13_19-23-43	2018-01-13 19:23:43
@@ -11,3 +27,772 @@ package main
 //hostname-2017-12-22_19-32-47	2017-12-22 19:32:47
 //hostname-2018-03-07_14-33-01	2018-03-07 14:33:01
 //`)
+
+// TestMain runs main instead of the tests when RUN_MAIN_ARGS is set, so
+// tests can check the behavior of the whole program, including its exit
+// status, by running the test binary as a subprocess.
+func TestMain(m *testing.M) {
+	if args := os.Getenv("RUN_MAIN_ARGS"); args != "" {
+		os.Args = append([]string{os.Args[0]}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs main with args in a subprocess and returns its combined
+// output and exit code.
+func runMain(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "RUN_MAIN_ARGS="+strings.Join(args, "\n"))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatal(err)
+		}
+		return string(out), exitErr.ExitCode()
+	}
+	return string(out), 0
+}
+
+// fakeTarsnap puts a fake tarsnap binary at the front of PATH, which runs
+// script with the arguments it was called with. It returns the path to a log
+// file that the script may write to via $FAKE_TARSNAP_LOG.
+func fakeTarsnap(t *testing.T, script string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tarsnap"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	logFile := filepath.Join(dir, "log")
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FAKE_TARSNAP_LOG", logFile)
+	return logFile
+}
+
+// logDeletes records the name following every -f flag, one per line.
+const logDeletes = `
+while [ $# -gt 0 ]; do
+	if [ "$1" = "-f" ]; then
+		shift
+		echo "$1" >> "$FAKE_TARSNAP_LOG"
+	fi
+	shift
+done
+`
+
+func TestDeleterDeletesEachArchiveOnce(t *testing.T) {
+	logFile := fakeTarsnap(t, logDeletes)
+	items := make([]*archiveItem, 25)
+	plan := make([]decision, len(items))
+	for i := range items {
+		items[i] = &archiveItem{Name: fmt.Sprintf("archive-%02d", i)}
+		plan[i] = decision{items[i], actionDiscard, ""}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &deleter{
+		tarsnap:        newTarsnapCmd("tarsnap", "", "", ""),
+		batchSize:      4,
+		alreadyDeleted: map[string]bool{},
+		stats:          new(runStats),
+	}
+	d.run(ctx, cancel, d.batches(plan))
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]int)
+	for _, name := range strings.Fields(string(data)) {
+		seen[name]++
+	}
+	for i := range items {
+		if n := seen[items[i].Name]; n != 1 {
+			t.Errorf("%s: deleted %d times, want 1", items[i].Name, n)
+		}
+	}
+	if len(seen) != len(items) {
+		t.Errorf("deleted %d distinct archives, want %d", len(seen), len(items))
+	}
+	if n := d.stats.discarded.Load(); n != int64(len(items)) {
+		t.Errorf("stats: discarded %d, want %d", n, len(items))
+	}
+}
+
+func TestMainExitsNonZeroWhenDeleteFails(t *testing.T) {
+	logFile := fakeTarsnap(t, `
+case "$*" in
+*archive-02*)
+	if [ $# -gt 3 ]; then
+		echo "tarsnap: Archive does not exist" >&2
+	else
+		echo "tarsnap: Error reading key file" >&2
+	fi
+	exit 1
+	;;
+esac
+`+logDeletes)
+	// Daily archives from long ago, so all but the first are discarded by
+	// the monthly tier.
+	buf := new(bytes.Buffer)
+	for i := 0; i < 10; i++ {
+		d := time.Date(2015, 1, 1+i, 0, 0, 0, 0, time.UTC)
+		fmt.Fprintf(buf, "archive-%02d\t%s\n", i, d.Format("2006-01-02 15:04:05"))
+	}
+	listing := filepath.Join(t.TempDir(), "listing")
+	if err := os.WriteFile(listing, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runMain(t, "-dry-run=false", "-yes", "-timezone=UTC", "-batch-size=3",
+		"-archive-regex=^archive-", "-file="+listing)
+	if code != 1 {
+		t.Errorf("exit code: got %d, want 1. output:\n%s", code, out)
+	}
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Fields(string(data))
+	want := []string{"archive-01", "archive-03", "archive-04", "archive-05", "archive-06", "archive-07", "archive-08", "archive-09"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("deleted archives: got %v, want %v", got, want)
+	}
+}
+
+func TestMainPostHookRunsWhenDeleteAborts(t *testing.T) {
+	fakeTarsnap(t, `
+echo "tarsnap: Error reading key file" >&2
+exit 1
+`)
+	buf := new(bytes.Buffer)
+	for i := 0; i < 5; i++ {
+		d := time.Date(2015, 1, 1+i, 0, 0, 0, 0, time.UTC)
+		fmt.Fprintf(buf, "archive-%02d\t%s\n", i, d.Format("2006-01-02 15:04:05"))
+	}
+	listing := filepath.Join(t.TempDir(), "listing")
+	if err := os.WriteFile(listing, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runMain(t, "delete", "-yes", "-timezone=UTC", "-archive-regex=^archive-", "-file="+listing, "-post-hook=env")
+	if code != 1 {
+		t.Errorf("exit code: got %d, want 1. output:\n%s", code, out)
+	}
+	if !strings.Contains(out, "could not delete archives") {
+		t.Errorf("the run didn't abort:\n%s", out)
+	}
+	if !strings.Contains(out, "TARSNAP_ERRORS=4\n") {
+		t.Errorf("post hook didn't run with the failed archives counted:\n%s", out)
+	}
+}
+
+func TestMainPlanOutWhenDeleteAborts(t *testing.T) {
+	fakeTarsnap(t, `
+echo "tarsnap: Error reading key file" >&2
+exit 1
+`)
+	dir := t.TempDir()
+	listing := writeListing(t, time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC), 24*time.Hour, 5, "archive-")
+	planOut := filepath.Join(dir, "plan.json")
+	summaryOut := filepath.Join(dir, "summary.json")
+	out, code := runMain(t, "delete", "-yes", "-timezone=UTC", "-archive-regex=^archive-", "-file="+listing,
+		"-format=json", "-plan-out="+planOut, "-summary-out="+summaryOut)
+	if code != 1 {
+		t.Fatalf("exit code: got %d, want 1. output:\n%s", code, out)
+	}
+	f, err := os.Open(planOut)
+	if err != nil {
+		t.Fatalf("aborted run didn't write -plan-out: %v\noutput:\n%s", err, out)
+	}
+	defer f.Close()
+	actions, err := readJSONPlan(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := 0
+	for _, action := range actions {
+		if action == actionFailed {
+			failed++
+		}
+	}
+	if failed != 4 {
+		t.Errorf("got %d failed archives in -plan-out, want 4: %v", failed, actions)
+	}
+	data, err := os.ReadFile(summaryOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary runSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.FailedArchives) != 4 {
+		t.Errorf("got failed archives %q in -summary-out, want 4", summary.FailedArchives)
+	}
+}
+
+func TestDeleterRetriesNetworkErrors(t *testing.T) {
+	logFile := fakeTarsnap(t, `
+count_file="$FAKE_TARSNAP_LOG.count"
+count=$(cat "$count_file" 2>/dev/null || echo 0)
+echo $((count + 1)) > "$count_file"
+if [ "$count" -lt 2 ]; then
+	echo "tarsnap: Error connecting to server" >&2
+	exit 1
+fi
+`+logDeletes)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	item := &archiveItem{Name: "archive-00"}
+	d := &deleter{
+		tarsnap:        newTarsnapCmd("tarsnap", "", "", ""),
+		batchSize:      10,
+		alreadyDeleted: map[string]bool{},
+		stats:          new(runStats),
+		maxRetries:     3,
+		retryDelay:     time.Millisecond,
+	}
+	d.run(ctx, cancel, d.batches([]decision{{item, actionDiscard, ""}}))
+	count, err := os.ReadFile(logFile + ".count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(count)); got != "3" {
+		t.Errorf("tarsnap ran %s times, want 3", got)
+	}
+	if n := d.stats.discarded.Load(); n != 1 {
+		t.Errorf("stats: discarded %d, want 1", n)
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	const delay = time.Second
+	waits := func(seed int64) []time.Duration {
+		d := &deleter{jitter: 0.25, jitterRand: rand.New(rand.NewSource(seed))}
+		w := make([]time.Duration, 20)
+		for i := range w {
+			w[i] = d.jittered(delay)
+		}
+		return w
+	}
+	first := waits(1)
+	spread := false
+	for i, w := range first {
+		if w < 750*time.Millisecond || w > 1250*time.Millisecond {
+			t.Errorf("wait %d: got %v, want within 25%% of %v", i, w, delay)
+		}
+		if w != first[0] {
+			spread = true
+		}
+	}
+	if !spread {
+		t.Errorf("every wait was %v, want them spread out", first[0])
+	}
+	if again := waits(1); fmt.Sprint(again) != fmt.Sprint(first) {
+		t.Errorf("same seed gave different waits:\n%v\n%v", first, again)
+	}
+	d := &deleter{jitterRand: rand.New(rand.NewSource(1))}
+	if w := d.jittered(delay); w != delay {
+		t.Errorf("with no jitter: got %v, want %v", w, delay)
+	}
+}
+
+// fakeArchives is a Tarsnap that keeps its archives in memory. Deleting an
+// archive in gone fails with errAlreadyDeleted, and deleting one in broken
+// fails with a permanent error.
+type fakeArchives struct {
+	mu      sync.Mutex
+	gone    map[string]bool
+	broken  map[string]bool
+	deleted []string
+	calls   int
+}
+
+func (f *fakeArchives) ListArchives(ctx context.Context) (io.Reader, error) {
+	return strings.NewReader(""), nil
+}
+
+func (f *fakeArchives) Delete(ctx context.Context, archives []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	for _, name := range archives {
+		if f.gone[name] {
+			return errAlreadyDeleted
+		}
+		if f.broken[name] {
+			return fmt.Errorf("deleting %s: exit status 1", name)
+		}
+	}
+	f.deleted = append(f.deleted, archives...)
+	return nil
+}
+
+func TestDeleterWithFakeTarsnap(t *testing.T) {
+	fake := &fakeArchives{
+		gone:   map[string]bool{"archive-05": true},
+		broken: map[string]bool{"archive-09": true},
+	}
+	plan := make([]decision, 10)
+	for i := range plan {
+		plan[i] = decision{&archiveItem{Name: fmt.Sprintf("archive-%02d", i)}, actionDiscard, ""}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &deleter{
+		tarsnap:         fake,
+		batchSize:       4,
+		alreadyDeleted:  map[string]bool{},
+		stats:           new(runStats),
+		continueOnError: true,
+	}
+	d.run(ctx, cancel, d.batches(plan))
+	// The batch with archive-05 is retried one archive at a time, and the
+	// batch with archive-09 fails as a whole.
+	if got, want := strings.Join(fake.deleted, " "), "archive-00 archive-01 archive-02 archive-03 archive-04 archive-06 archive-07"; got != want {
+		t.Errorf("deleted %s, want %s", got, want)
+	}
+	if fake.calls != 7 {
+		t.Errorf("tarsnap was called %d times, want 7", fake.calls)
+	}
+	if got := strings.Join(d.failed(), " "); got != "archive-08 archive-09" {
+		t.Errorf("failed %s, want archive-08 archive-09", got)
+	}
+	if gone := d.stats.gone.Load(); gone != 1 {
+		t.Errorf("stats: gone %d, want 1", gone)
+	}
+}
+
+func TestDeleterGroupTarsnap(t *testing.T) {
+	web, db, other := &fakeArchives{}, &fakeArchives{}, &fakeArchives{}
+	var plan []decision
+	for i := 0; i < 6; i++ {
+		for _, g := range []string{"web", "db", "other"} {
+			item := &archiveItem{Name: fmt.Sprintf("%s-%02d", g, i), Group: g}
+			plan = append(plan, decision{item, actionDiscard, ""})
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &deleter{
+		tarsnap:        other,
+		groupTarsnap:   map[string]Tarsnap{"web": web, "db": db},
+		batchSize:      4,
+		concurrency:    3,
+		alreadyDeleted: map[string]bool{},
+		stats:          new(runStats),
+	}
+	d.run(ctx, cancel, d.batches(plan))
+	for _, tt := range []struct {
+		group string
+		fake  *fakeArchives
+	}{{"web", web}, {"db", db}, {"other", other}} {
+		if len(tt.fake.deleted) != 6 {
+			t.Errorf("%s: deleted %v, want 6 archives", tt.group, tt.fake.deleted)
+		}
+		for _, name := range tt.fake.deleted {
+			if !strings.HasPrefix(name, tt.group+"-") {
+				t.Errorf("%s: deleted %s, from another group", tt.group, name)
+			}
+		}
+		// 6 archives in batches of 4
+		if tt.fake.calls != 2 {
+			t.Errorf("%s: tarsnap was called %d times, want 2", tt.group, tt.fake.calls)
+		}
+	}
+}
+
+func TestCheckConcurrentGroups(t *testing.T) {
+	items := []*archiveItem{{Name: "web-1", Group: "web"}, {Name: "db-1", Group: "db"}}
+	keyfiles := map[string]string{"web": "/web.key", "db": "/db.key"}
+	cachedirs := map[string]string{"web": "/cache/web", "db": "/cache/db"}
+	if err := checkConcurrentGroups(items, keyfiles, cachedirs); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name                string
+		keyfiles, cachedirs map[string]string
+	}{
+		{"no keyfile", map[string]string{"web": "/web.key"}, cachedirs},
+		{"no cachedir", keyfiles, map[string]string{"db": "/cache/db"}},
+		{"shared keyfile", map[string]string{"web": "/k", "db": "/k"}, cachedirs},
+		{"shared cachedir", keyfiles, map[string]string{"web": "/c", "db": "/c"}},
+	} {
+		if err := checkConcurrentGroups(items, tt.keyfiles, tt.cachedirs); err == nil {
+			t.Errorf("%s: expected an error, got nil", tt.name)
+		}
+	}
+	for _, specs := range [][]string{{"web"}, {"=/web.key"}, {"web="}, {"web=/a", "web=/b"}} {
+		if _, err := parseGroupPaths("group-keyfile", specs); err == nil {
+			t.Errorf("%q: expected an error, got nil", specs)
+		}
+	}
+}
+
+func TestCompileArchiveRegexIgnoreCase(t *testing.T) {
+	tests := []struct {
+		regex      string
+		strict     bool
+		ignoreCase bool
+		name       string
+		want       bool
+	}{
+		{"db-", false, false, "host-DB-2024", false},
+		{"db-", false, true, "host-DB-2024", true},
+		{"^HOST-db-.*$", true, true, "host-DB-2024", true},
+		{"^host-", false, true, "web-HOST-2024", false},
+	}
+	for _, tt := range tests {
+		rx, err := compileArchiveRegex(tt.regex, tt.strict, tt.ignoreCase)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.regex, err)
+		}
+		if got := rx.MatchString(tt.name); got != tt.want {
+			t.Errorf("%q (ignore case %t) matching %q: got %t, want %t", tt.regex, tt.ignoreCase, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	after := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		d             time.Time
+		after, before time.Time
+		want          bool
+	}{
+		{"at after", after, after, before, true},
+		{"just before after", after.Add(-time.Second), after, before, false},
+		{"inside", time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC), after, before, true},
+		{"just before before", before.Add(-time.Second), after, before, true},
+		{"at before", before, after, before, false},
+		{"no after", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}, before, true},
+		{"no before", time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC), after, time.Time{}, true},
+		{"other zone", time.Date(2024, 3, 31, 20, 0, 0, 0, time.FixedZone("EDT", -4*3600)), after, before, false},
+	}
+	for _, tt := range tests {
+		if got := inWindow(tt.d, tt.after, tt.before); got != tt.want {
+			t.Errorf("%s: inWindow(%v) = %t, want %t", tt.name, tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixGroup(t *testing.T) {
+	tests := []struct {
+		name, sep, want string
+	}{
+		{"backup/daily/2024-01-01", "/", "backup/daily"},
+		{"backup/weekly/20240101", "/", "backup/weekly"},
+		{"db_2024-01-01_03-00-00", "_", ""},
+		{"db-2024-01-01_03-00-00", "/", ""},
+		{"backup/daily/latest", "/", ""},
+		{"host.2024-01-01T03:00", ".", "host"},
+	}
+	for _, tt := range tests {
+		if got := prefixGroup(tt.name, tt.sep); got != tt.want {
+			t.Errorf("prefixGroup(%q, %q) = %q, want %q", tt.name, tt.sep, got, tt.want)
+		}
+	}
+}
+
+func TestSelectArchives(t *testing.T) {
+	o := testOptions(t, "-host", "web", "-archive-regex", "^web-(?P<group>[a-z]+)-", "-exclude-regex", "-keep$",
+		"-after", "2024-01-02T00:00:00Z")
+	if err := o.validate(); err != nil {
+		t.Fatal(err)
+	}
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 3, 0, 0, 0, time.UTC) }
+	items := []*archiveItem{
+		{Name: "web-app-2024-01-01", Date: day(1)},
+		{Name: "web-app-2024-01-03", Date: day(3)},
+		{Name: "web-db-2024-01-03", Date: day(3)},
+		{Name: "web-db-2024-01-03-keep", Date: day(3)},
+		{Name: "web-db-latest"},
+		{Name: "db-app-2024-01-03", Date: day(3)},
+		{Name: "web-2024-01-03", Date: day(3)},
+	}
+	matched, excluded, undated := o.selectArchives(items)
+	names := func(items []*archiveItem) string {
+		s := make([]string, len(items))
+		for i := range items {
+			s[i] = items[i].Group + ":" + items[i].Name
+		}
+		return strings.Join(s, " ")
+	}
+	if got, want := names(matched), "app:web-app-2024-01-03 db:web-db-2024-01-03"; got != want {
+		t.Errorf("matched %s, want %s", got, want)
+	}
+	if got, want := names(excluded), "db:web-db-2024-01-03-keep"; got != want {
+		t.Errorf("excluded %s, want %s", got, want)
+	}
+	// The time window doesn't apply to archives with no date.
+	if got, want := names(undated), "db:web-db-latest"; got != want {
+		t.Errorf("undated %s, want %s", got, want)
+	}
+}
+
+func TestPlanArchives(t *testing.T) {
+	o := testOptions(t, "-archive-regex", "^web-", "-timezone", "UTC", "-now", "2024-01-10T00:00:00Z",
+		"-delete-all-matching", "-dry-run=false", "-yes", "-min-age", "2d", "-keep-newest-per-group")
+	if err := o.validate(); err != nil {
+		t.Fatal(err)
+	}
+	pol, err := o.policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	matched := dailyItems(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC))
+	matched = append(matched, &archiveItem{Name: "hostname-2024-01-09", Date: time.Date(2024, 1, 9, 0, 0, 0, 0, time.UTC)})
+	excluded := []*archiveItem{{Name: "hostname-2024-01-02-keep", Date: time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)}}
+	undated := []*archiveItem{{Name: "hostname-latest"}}
+	plan := o.planArchives(pol, matched, excluded, undated, map[string]bool{"hostname-2024-01-01": true})
+	got := make([]string, len(plan))
+	for i := range plan {
+		got[i] = plan[i].label() + " " + plan[i].Item.Name
+	}
+	want := []string{
+		"keep[undated] hostname-latest",
+		"gone hostname-2024-01-01",
+		"discard hostname-2024-01-02",
+		"excluded hostname-2024-01-02-keep",
+		"discard hostname-2024-01-03",
+		// -keep-newest-per-group doesn't count archives newer than
+		// -min-age, which are kept anyway.
+		"discard hostname-2024-01-04",
+		"keep[min-age] hostname-2024-01-09",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("plan:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestBatchesCapArgvLength(t *testing.T) {
+	// 100 archives with 10KB names are far more than maxArgBytes in one
+	// batch.
+	items := make([]*archiveItem, 100)
+	plan := make([]decision, len(items))
+	for i := range items {
+		items[i] = &archiveItem{Name: fmt.Sprintf("%03d-%s", i, strings.Repeat("x", 10000))}
+		plan[i] = decision{items[i], actionDiscard, ""}
+	}
+	d := &deleter{batchSize: 100, stats: new(runStats)}
+	batches, total := 0, 0
+	for batch := range d.batches(plan) {
+		batches++
+		total += len(batch)
+		size := 0
+		for _, name := range batch {
+			size += len(name) + 4
+		}
+		if size > maxArgBytes {
+			t.Errorf("batch of %d archives has %d bytes of arguments, want at most %d", len(batch), size, maxArgBytes)
+		}
+	}
+	if batches < 2 {
+		t.Errorf("got %d batches, want the archives split into several", batches)
+	}
+	if total != len(items) {
+		t.Errorf("batched %d archives, want %d", total, len(items))
+	}
+}
+
+func TestMainHostFilter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for i, host := range []string{"db", "db2", "www", "db"} {
+		d := time.Date(2015, 1, 1+i, 0, 0, 0, 0, time.UTC)
+		fmt.Fprintf(buf, "%s-%s\t%s\n", host, d.Format("2006-01-02"), d.Format("2006-01-02 15:04:05"))
+	}
+	listing := filepath.Join(t.TempDir(), "listing")
+	if err := os.WriteFile(listing, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runMain(t, "-timezone=UTC", "-host=db", "-file="+listing)
+	if code != 0 {
+		t.Fatalf("exit code: got %d, want 0. output:\n%s", code, out)
+	}
+	var planned []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && (strings.HasPrefix(fields[0], "keep") || fields[0] == "discard") {
+			planned = append(planned, fields[1])
+		}
+	}
+	want := []string{"db-2015-01-01", "db-2015-01-04"}
+	if strings.Join(planned, " ") != strings.Join(want, " ") {
+		t.Errorf("planned archives: got %v, want %v. output:\n%s", planned, want, out)
+	}
+}
+
+func TestMainFailOnEmptyMatch(t *testing.T) {
+	listing := writeListing(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), 24*time.Hour, 10, "web-")
+	if out, code := runMain(t, "-file", listing, "-archive-regex", "^db-"); code != 0 {
+		t.Errorf("without -fail-on-empty-match: exit code %d, want 0\n%s", code, out)
+	}
+	out, code := runMain(t, "-file", listing, "-archive-regex", "^db-", "-fail-on-empty-match")
+	if code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+	if !strings.Contains(out, "no archives matched") {
+		t.Errorf("output doesn't explain the failure:\n%s", out)
+	}
+}
+
+func TestMainMissingTarsnap(t *testing.T) {
+	out, code := runMain(t, "-archive-regex", ".", "-tarsnap-bin", filepath.Join(t.TempDir(), "tarsnap"))
+	if code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+	if !strings.Contains(out, "-tarsnap-bin") || !strings.Contains(out, "-file") {
+		t.Errorf("output doesn't say how to fix the problem:\n%s", out)
+	}
+}
+
+func TestMainWithoutTarsnapForPlanOrNames(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "tarsnap")
+	names := filepath.Join(dir, "names")
+	if err := os.WriteFile(names, []byte("web-1\nweb-2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	item := &archiveItem{Name: "web-1", Date: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err := writeJSONPlan(&buf, []decision{{item, actionDiscard, ""}}); err != nil {
+		t.Fatal(err)
+	}
+	planFile := filepath.Join(dir, "plan.json")
+	if err := os.WriteFile(planFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"plan", "-delete-names-file", names},
+		{"delete", "-delete-names-file", names, "-no-exec", "-yes"},
+		{"plan", "-execute-plan", planFile},
+		{"delete", "-execute-plan", planFile, "-no-exec", "-yes"},
+	} {
+		out, code := runMain(t, append(args, "-tarsnap-bin", missing)...)
+		if code != 0 {
+			t.Errorf("%q: exit code %d, want 0\n%s", args, code, out)
+		}
+	}
+}
+
+func TestMainPrintKept(t *testing.T) {
+	listing := writeListing(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), 24*time.Hour, 3, "web-")
+	args := []string{"-file", listing, "-archive-regex", "^web-", "-keep-latest", "1", "-dry-run=false", "-yes", "-no-exec"}
+	out, code := runMain(t, args...)
+	if code != 0 {
+		t.Fatalf("exit code %d, want 0\n%s", code, out)
+	}
+	if strings.Contains(out, "keep[") {
+		t.Errorf("kept archives printed without -print-kept:\n%s", out)
+	}
+	out, code = runMain(t, append(args, "-print-kept", "-exclude-regex", "^web-2020-01-01")...)
+	if code != 0 {
+		t.Fatalf("exit code %d, want 0\n%s", code, out)
+	}
+	if !strings.Contains(out, "keep[latest] web-") || !strings.Contains(out, "excluded web-2020-01-01") {
+		t.Errorf("output doesn't list the kept archives:\n%s", out)
+	}
+}
+
+func TestMainCalendarMonths(t *testing.T) {
+	listing := writeListing(t, time.Date(2021, 1, 15, 0, 0, 0, 0, time.UTC), 24*time.Hour, 80, "web-")
+	args := []string{"plan", "-file", listing, "-archive-regex", "^web-", "-timezone", "UTC", "-now", "2024-06-15T12:00:00Z"}
+	tests := []struct {
+		flag string
+		want []string
+	}{
+		{"-calendar-months=false", []string{"2021-01-15", "2021-02-15", "2021-03-15"}},
+		{"-calendar-months", []string{"2021-01-15", "2021-02-01", "2021-03-01", "2021-04-01"}},
+	}
+	for _, tt := range tests {
+		out, code := runMain(t, append(args, tt.flag)...)
+		if code != 0 {
+			t.Fatalf("%s: exit code %d, want 0\n%s", tt.flag, code, out)
+		}
+		var kept []string
+		for _, line := range strings.Split(out, "\n") {
+			if name, ok := strings.CutPrefix(line, "keep[monthly] web-"); ok {
+				kept = append(kept, name[:len("2006-01-02")])
+			}
+		}
+		if fmt.Sprint(kept) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: kept %v, want %v\n%s", tt.flag, kept, tt.want, out)
+		}
+	}
+}
+
+func TestMainCommands(t *testing.T) {
+	listing := writeListing(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), 24*time.Hour, 3, "web-")
+	args := []string{"-file", listing, "-archive-regex", "^web-", "-keep-latest", "1"}
+	out, code := runMain(t, append([]string{"plan"}, args...)...)
+	if code != 0 {
+		t.Fatalf("plan: exit code %d, want 0\n%s", code, out)
+	}
+	if !strings.Contains(out, "discard web-") || strings.Contains(out, "deprecated") {
+		t.Errorf("plan: unexpected output:\n%s", out)
+	}
+	out, code = runMain(t, append([]string{"delete", "-no-exec", "-yes"}, args...)...)
+	if code != 0 {
+		t.Fatalf("delete: exit code %d, want 0\n%s", code, out)
+	}
+	if !strings.Contains(out, "deleted web-") {
+		t.Errorf("delete: no archives deleted:\n%s", out)
+	}
+	out, code = runMain(t, "list", "-file", listing, "-archive-regex", "^web-")
+	if code != 0 {
+		t.Fatalf("list: exit code %d, want 0\n%s", code, out)
+	}
+	if strings.Count(out, "web-") != 3 || strings.Contains(out, "discard") {
+		t.Errorf("list: unexpected output:\n%s", out)
+	}
+	// The old form still works, with a warning.
+	out, code = runMain(t, args...)
+	if code != 0 || !strings.Contains(out, "discard web-") || !strings.Contains(out, "deprecated") {
+		t.Errorf("without a command: exit code %d, output:\n%s", code, out)
+	}
+	if out, code := runMain(t, append([]string{"plan", "-dry-run=false"}, args...)...); code != 1 {
+		t.Errorf("plan -dry-run=false: exit code %d, want 1\n%s", code, out)
+	}
+	// Flags that don't apply to a command are rejected.
+	for _, args := range [][]string{
+		{"list", "-yes"},
+		{"list", "-keep-latest", "1"},
+		{"plan", "-post-hook", "true"},
+		{"delete", "-dry-run-mark-deleted"},
+	} {
+		out, code := runMain(t, append(args, "-file", listing, "-archive-regex", "^web-")...)
+		if code != 1 || !strings.Contains(out, "can't be used with the "+args[0]+" command") {
+			t.Errorf("%q: exit code %d, output:\n%s", args, code, out)
+		}
+	}
+	out, _ = runMain(t, "list", "-h")
+	if !strings.Contains(out, "-archive-regex") || strings.Contains(out, "-yes") || strings.Contains(out, "-keep-latest") {
+		t.Errorf("list -h: unexpected flags:\n%s", out)
+	}
+	if out, code := runMain(t, append([]string{"remove"}, args...)...); code != 1 || !strings.Contains(out, "unknown command") {
+		t.Errorf("unknown command: exit code %d, output:\n%s", code, out)
+	}
+}
+
+func TestMainNoExecAuditLog(t *testing.T) {
+	listing := writeListing(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), 24*time.Hour, 3, "web-")
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	out, code := runMain(t, "delete", "-no-exec", "-yes", "-file", listing, "-archive-regex", "^web-", "-keep-latest", "1",
+		"-audit-log", auditFile, "-post-hook", "env")
+	if code != 0 {
+		t.Fatalf("exit code %d, want 0\n%s", code, out)
+	}
+	if !strings.Contains(out, "TARSNAP_DELETED=0\n") || !strings.Contains(out, "TARSNAP_SIMULATED=1\n") {
+		t.Errorf("post hook environment doesn't say the delete was simulated:\n%s", out)
+	}
+	audit, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(audit), `"result":"simulated"`) || strings.Contains(string(audit), `"result":"deleted"`) {
+		t.Errorf("audit log doesn't say the delete was simulated:\n%s", audit)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics holds the Prometheus metrics for a run. A nil *metrics records
+// nothing. There are only a handful of them, so they're written out in the
+// Prometheus text format by hand rather than with the client library.
+type metrics struct {
+	kept          counter
+	discarded     counter
+	gone          counter
+	failed        counter
+	batchDuration histogram
+}
+
+// A counter is a Prometheus counter.
+type counter struct {
+	name, help string
+	n          atomic.Int64
+}
+
+func (c *counter) Add(n int64) {
+	c.n.Add(n)
+}
+
+func (c *counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.n.Load())
+}
+
+// A histogram is a Prometheus histogram. It is safe for concurrent use.
+type histogram struct {
+	name, help string
+	// upper bounds of the buckets, in increasing order, not counting +Inf
+	buckets []float64
+
+	mu sync.Mutex
+	// counts[i] is the number of observations in buckets[i], but not in
+	// any smaller bucket; the last one is for +Inf.
+	counts []int64
+	sum    float64
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]int64, len(h.buckets)+1)
+	}
+	i := 0
+	for i < len(h.buckets) && v > h.buckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var total int64
+	for i := range h.buckets {
+		if h.counts != nil {
+			total += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, strconv.FormatFloat(h.buckets[i], 'g', -1, 64), total)
+	}
+	if h.counts != nil {
+		total += h.counts[len(h.buckets)]
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, total)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, total)
+}
+
+// exponentialBuckets returns n bucket bounds, starting at start and each
+// factor times the last.
+func exponentialBuckets(start, factor float64, n int) []float64 {
+	b := make([]float64, n)
+	for i := range b {
+		b[i] = start
+		start *= factor
+	}
+	return b
+}
+
+func newMetrics() *metrics {
+	m := new(metrics)
+	m.kept.name, m.kept.help = "tarsnap_old_archives_kept_total", "Number of archives kept by the retention policy."
+	m.discarded.name, m.discarded.help = "tarsnap_old_archives_discarded_total", "Number of archives deleted."
+	m.gone.name, m.gone.help = "tarsnap_old_archives_gone_total", "Number of archives that were already deleted."
+	m.failed.name, m.failed.help = "tarsnap_old_archives_failed_total", "Number of archives that could not be deleted."
+	m.batchDuration.name = "tarsnap_old_archives_delete_batch_duration_seconds"
+	m.batchDuration.help = "How long each tarsnap delete command took."
+	m.batchDuration.buckets = exponentialBuckets(0.5, 2, 12)
+	return m
+}
+
+// writeTo writes m in the Prometheus text exposition format.
+func (m *metrics) writeTo(w io.Writer) {
+	for _, c := range []*counter{&m.kept, &m.discarded, &m.gone, &m.failed} {
+		c.write(w)
+	}
+	m.batchDuration.write(w)
+}
+
+// serve serves m on addr until stop is called.
+func (m *metrics) serve(addr string) (stop func(), err error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.writeTo(w)
+	})
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", "err", err)
+		}
+	}()
+	slog.Info("serving metrics", "addr", ln.Addr().String())
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}, nil
+}
+
+func (m *metrics) observeBatch(d time.Duration) {
+	if m != nil {
+		m.batchDuration.Observe(d.Seconds())
+	}
+}
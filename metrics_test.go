@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := newMetrics()
+	m.discarded.Add(3)
+	m.observeBatch(300 * time.Millisecond)
+	m.observeBatch(3 * time.Second)
+	m.observeBatch(time.Hour)
+	buf := new(bytes.Buffer)
+	m.writeTo(buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE tarsnap_old_archives_discarded_total counter\ntarsnap_old_archives_discarded_total 3\n",
+		"tarsnap_old_archives_kept_total 0\n",
+		"# TYPE tarsnap_old_archives_delete_batch_duration_seconds histogram\n",
+		`tarsnap_old_archives_delete_batch_duration_seconds_bucket{le="0.5"} 1` + "\n",
+		`tarsnap_old_archives_delete_batch_duration_seconds_bucket{le="2"} 1` + "\n",
+		`tarsnap_old_archives_delete_batch_duration_seconds_bucket{le="4"} 2` + "\n",
+		`tarsnap_old_archives_delete_batch_duration_seconds_bucket{le="1024"} 2` + "\n",
+		`tarsnap_old_archives_delete_batch_duration_seconds_bucket{le="+Inf"} 3` + "\n",
+		"tarsnap_old_archives_delete_batch_duration_seconds_sum 3603.3\n",
+		"tarsnap_old_archives_delete_batch_duration_seconds_count 3\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
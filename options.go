@@ -0,0 +1,436 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// options holds the command line flags, and what validate parses them into.
+type options struct {
+	fs *flag.FlagSet
+
+	summaryOut        string
+	configFile        string
+	dryRun            bool
+	file              string
+	nameDateFormat    string
+	skipUnparseable   bool
+	quietGone         bool
+	printKept         bool
+	showProgress      bool
+	saveListing       bool
+	cacheList         bool
+	cacheTTL          time.Duration
+	batchSize         int
+	concurrency       int
+	sequential        bool
+	alreadyDeleted    string
+	keyfile           string
+	groupKeyfiles     stringsFlag
+	groupCachedirs    stringsFlag
+	cachedir          string
+	tarsnapBin        string
+	configfile        string
+	auditLogFile      string
+	appendDeleted     bool
+	markDeleted       string
+	regexes           stringsFlag
+	failOnEmpty       bool
+	ignoreCase        bool
+	strictRegex       bool
+	groupByPrefix     bool
+	prefixSeparator   string
+	host              string
+	excludeRegexes    stringsFlag
+	monthlyAfter      string
+	weeklyAfter       string
+	dailyAfter        string
+	calendarMonths    bool
+	weekStartFlag     string
+	keepAllAfter      string
+	olderThan         string
+	maxAge            string
+	minAge            string
+	keepNewest        bool
+	keepLatest        int
+	sizes             bool
+	targetFree        int64
+	deleteAllMatching bool
+	maxDelete         int
+	force             bool
+	reconcile         bool
+	verify            bool
+	interactive       bool
+	yes               bool
+	groupPolicies     stringsFlag
+	policyName        string
+	gfs               gfsCounts
+	timezone          string
+	verbose           bool
+	logFormat         string
+	format            string
+	timeout           time.Duration
+	onError           string
+	maxRetries        int
+	retryDelay        time.Duration
+	retryJitter       float64
+	retryJitterSeed   int64
+	metricsAddr       string
+	after             string
+	before            string
+	strict            bool
+	postHook          string
+	postHookRequired  bool
+	countOnly         bool
+	listOnly          bool
+	planOut           string
+	calendar          bool
+	sortOrder         string
+	deleteNamesFile   string
+	executePlan       string
+	nowFlag           string
+	previousPlan      string
+	delay             time.Duration
+	printStats        bool
+	noExec            bool
+	simulateLatency   time.Duration
+
+	// Set by validate.
+	rxs, excludeRxs                   []*regexp.Regexp
+	groupKeyfileMap, groupCachedirMap map[string]string
+	afterTime, beforeTime             time.Time
+	// the time that cutoffs are computed from, -now if it's set
+	now time.Time
+}
+
+// newOptions defines the flags on fs, and returns the options they set once fs
+// is parsed.
+func newOptions(fs *flag.FlagSet) *options {
+	o := &options{fs: fs}
+	fs.StringVar(&o.summaryOut, "summary-out", "", "Write a JSON summary of the run, including any archives that couldn't be deleted, to this file when the run ends, whether or not it succeeds. Use /dev/fd/N to write to an open file descriptor")
+	fs.StringVar(&o.configFile, "config", "", "File, in a small subset of TOML with one key = value per line, setting any of -archive-regex, -exclude-regex, the retention policy, -keyfile, -cachedir, -batch-size, -timeout and a few others, using the flag names as keys. Flags on the command line take precedence")
+	fs.BoolVar(&o.dryRun, "dry-run", true, "Dry run mode. Deprecated: use the plan or delete command")
+	fs.StringVar(&o.file, "file", "", "Name of file to load archives from, or - for stdin. The file may be gzipped")
+	fs.StringVar(&o.nameDateFormat, "name-date-format", "", "Take each archive's date from its name, using this Go time layout (e.g. 20060102.1504 for daily.20240101.0855), instead of the date tarsnap reports. "+
+		"Archives with no date in their name keep the date tarsnap reports. With this set, a listing from tarsnap --list-archives without -v can be read with -file")
+	fs.BoolVar(&o.skipUnparseable, "skip-unparseable", false, "Skip lines in the archive listing that can't be parsed, and report them at the end, instead of exiting")
+	fs.BoolVar(&o.quietGone, "quiet-gone", false, "Don't print a line for each archive that is already gone. They are still counted in the summary")
+	fs.BoolVar(&o.printKept, "print-kept", false, "After a real run, also print the archives that were kept, including those matching -exclude-regex, with the reason each was kept, so the output accounts for every archive. "+
+		"The CSV output already includes them")
+	fs.BoolVar(&o.showProgress, "progress", false, "Print how many archives have been deleted so far to stderr")
+	fs.BoolVar(&o.saveListing, "save-listing", false, "Save the archive listing from tarsnap to a temporary file, for debugging or for use with -file")
+	fs.BoolVar(&o.cacheList, "cache-list", false, "Save the archive listing from tarsnap and reuse it on later runs until it is older than -cache-ttl. "+
+		"The cache is kept per -tarsnap-configfile, -keyfile and -cachedir, and is discarded after a run that deletes archives")
+	fs.DurationVar(&o.cacheTTL, "cache-ttl", time.Hour, "How long a listing saved by -cache-list is reused")
+	fs.IntVar(&o.batchSize, "batch-size", 100, "Batch size")
+	// Tarsnap does not permit concurrent operations with the same key and
+	// cache directory.
+	fs.IntVar(&o.concurrency, "concurrency", 1, "Number of tarsnap delete commands to run at once. Tarsnap doesn't allow concurrent operations "+
+		"with one key and cache directory, so values above 1 need -group-keyfile and -group-cachedir for every group with archives to delete, "+
+		"and only one command runs for each group at a time")
+	fs.BoolVar(&o.sequential, "sequential", false, "Delete archives one at a time, logging progress after each one, instead of in batches of -batch-size. "+
+		"This runs tarsnap once per archive, which is slower when every archive exists, but an archive that is already gone costs one call "+
+		"instead of failing its whole batch and forcing the batch to be retried one archive at a time")
+	// one entry per line
+	fs.StringVar(&o.alreadyDeleted, "already-deleted-file", "", "Name of file to load already deleted archives from")
+	fs.StringVar(&o.keyfile, "keyfile", "", "Tarsnap key file to use, passed on to tarsnap as --keyfile. Defaults to $TARSNAP_KEYFILE")
+	fs.Var(&o.groupKeyfiles, "group-keyfile", "Delete the archives in one group with its own tarsnap key file, like web01=/root/web01.key, instead of -keyfile. "+
+		"The archives are still listed with -keyfile, so with several keys, pass a combined listing with -file. Repeat for each group")
+	fs.Var(&o.groupCachedirs, "group-cachedir", "Delete the archives in one group with its own tarsnap cache directory, like web01=/var/cache/tarsnap-web01, instead of -cachedir. Repeat for each group")
+	fs.StringVar(&o.cachedir, "cachedir", "", "Tarsnap cache directory to use, passed on to tarsnap as --cachedir. Defaults to $TARSNAP_CACHEDIR")
+	fs.StringVar(&o.tarsnapBin, "tarsnap-bin", "tarsnap", "Name of, or path to, the tarsnap binary")
+	fs.StringVar(&o.configfile, "tarsnap-configfile", "", "Tarsnap config file to use, passed on to tarsnap as --configfile")
+	fs.StringVar(&o.auditLogFile, "audit-log", "", "Append a JSON line to this file for each archive as it is deleted, found to be gone or fails to delete, with the time, action, archive, result and error. "+
+		"With -no-exec, archives that would have been deleted have the result \"simulated\"")
+	fs.BoolVar(&o.appendDeleted, "append-deleted", false, "Append archives to -already-deleted-file as they are deleted")
+	fs.StringVar(&o.markDeleted, "dry-run-mark-deleted", "", "In dry run mode, write what -already-deleted-file would contain after deleting the planned archives to this file, or to stdout if it is \"-\". "+
+		"-already-deleted-file itself isn't changed")
+	fs.Var(&o.regexes, "archive-regex", "Regular expression to match archives against. Repeat to match archives against any of several patterns. Retention is applied separately to each value of a capture group named \"group\", if there is one. Defaults to $TARSNAP_ARCHIVE_REGEX")
+	fs.BoolVar(&o.failOnEmpty, "fail-on-empty-match", false, "Exit with an error if no archives match -archive-regex, after -exclude-regex and the other filters, which usually means a typo or the wrong account")
+	fs.BoolVar(&o.ignoreCase, "ignore-case", false, "Match -archive-regex and -exclude-regex without regard to case")
+	fs.BoolVar(&o.strictRegex, "strict-regex", false, "Require -archive-regex and -exclude-regex to be anchored with ^ and $, instead of matching anywhere in the name")
+	fs.BoolVar(&o.groupByPrefix, "group-by-prefix", false, "Apply retention separately to each group of archives whose names share everything before a trailing date, such as backup/daily in backup/daily/2024-01-01. Overrides a \"group\" capture group in -archive-regex")
+	fs.StringVar(&o.prefixSeparator, "prefix-separator", "/", "Separator before the trailing date in archive names, for -group-by-prefix")
+	fs.StringVar(&o.host, "host", "", "Only consider archives named <host>-..., as well as matching -archive-regex. If -archive-regex isn't set, every archive for the host matches")
+	fs.Var(&o.excludeRegexes, "exclude-regex", "Never delete archives matching this regular expression, regardless of age. May be repeated")
+	fs.StringVar(&o.monthlyAfter, "monthly-after", "2y", "Keep one archive per month once archives are older than this (e.g. 2y, 18mo)")
+	fs.StringVar(&o.weeklyAfter, "weekly-after", "2mo", "Keep one archive per week once archives are older than this (e.g. 2mo, 8w)")
+	fs.StringVar(&o.dailyAfter, "daily-after", "", "Keep only the first archive of each calendar day once archives are older than this, until -weekly-after (e.g. 0, 7d). "+
+		"Unless -keep-all-after is also set, it defaults to this value")
+	fs.BoolVar(&o.calendarMonths, "calendar-months", false, "Thin the monthly tier to the first archive of each calendar month, instead of one archive a month after the last one kept")
+	fs.StringVar(&o.weekStartFlag, "week-start", "", "Thin the weekly tier to the first archive of each calendar week starting on this day (e.g. monday), instead of one archive every seven days")
+	fs.StringVar(&o.keepAllAfter, "keep-all-after", "2mo", "Keep every archive newer than this (e.g. 2mo, 30d), even if it is older than -weekly-after or -daily-after")
+	fs.StringVar(&o.olderThan, "older-than", "", "Instead of the retention policy, discard every archive older than this (e.g. 90d, 6mo). -min-age and -keep-latest still apply")
+	fs.StringVar(&o.maxAge, "max-age", "", "Discard every archive older than this (e.g. 7y), whatever tier it is in. -min-age and -keep-latest still apply")
+	fs.StringVar(&o.minAge, "min-age", "14d", "Never delete archives newer than this, whatever the retention policy says")
+	fs.BoolVar(&o.keepNewest, "keep-newest-per-group", false, "Never delete the newest archive in each group, whatever the retention policy says, so every group keeps at least one archive. "+
+		"This applies to -delete-all-matching too")
+	fs.IntVar(&o.keepLatest, "keep-latest", 0, "Always keep this many of the most recent archives, in each group if -archive-regex has a group")
+	fs.BoolVar(&o.sizes, "sizes", false, "Fetch the size of each matched archive with tarsnap --print-stats. This is slow")
+	fs.Int64Var(&o.targetFree, "target-free", 0, "Of the archives the retention policy would delete, only delete the largest, until their compressed sizes add up to this many bytes. Implies -sizes")
+	fs.BoolVar(&o.deleteAllMatching, "delete-all-matching", false, "Delete every archive matching -archive-regex, ignoring the retention policy. Archives newer than -min-age, which can be 0, and archives matching -exclude-regex are still kept. Requires -yes, and -max-delete still applies")
+	fs.IntVar(&o.maxDelete, "max-delete", 0, "Refuse to delete anything if the plan would delete more than this many archives. 0 means no limit")
+	fs.BoolVar(&o.force, "force", false, "Delete archives even if there are more than -max-delete, or, with -reconcile, if they aren't in the live listing")
+	fs.BoolVar(&o.reconcile, "reconcile", false, "With -file, also list archives from tarsnap and warn about any differences. Archives that aren't in the live listing aren't deleted unless -force is given")
+	fs.BoolVar(&o.verify, "verify", false, "Run tarsnap --fsck before deleting anything, and exit if it fails. This can take a while on large accounts")
+	fs.BoolVar(&o.interactive, "interactive", false, "Ask before deleting each archive. Answer a to delete the rest without asking, or q to stop asking and delete only the archives approved so far. Ignored if stdin is not a terminal")
+	fs.BoolVar(&o.yes, "yes", false, "Delete archives without asking for confirmation")
+	fs.Var(&o.groupPolicies, "group-policy", "Retention settings for one group of archives, from a \"group\" capture group or -group-by-prefix, "+
+		"that override the flags for that group, like web01:monthly-after=1y,keep-latest=10 or host=web01:monthly-after=1y. The keys are the names of the retention flags. Repeat for each group. A real run exits if no matched archive is in the group")
+	fs.StringVar(&o.policyName, "policy", "legacy", "Retention policy: legacy (the -monthly-after/-weekly-after tiers) or gfs (grandfather-father-son)")
+	fs.IntVar(&o.gfs.daily, "daily", 7, "With -policy gfs, the number of daily archives to keep")
+	fs.IntVar(&o.gfs.weekly, "weekly", 4, "With -policy gfs, the number of weekly archives to keep")
+	fs.IntVar(&o.gfs.monthly, "monthly", 12, "With -policy gfs, the number of monthly archives to keep")
+	fs.IntVar(&o.gfs.yearly, "yearly", 10, "With -policy gfs, the number of yearly archives to keep")
+	fs.StringVar(&o.timezone, "timezone", "Local", "Time zone that archive timestamps are in, e.g. UTC or America/New_York")
+	fs.BoolVar(&o.verbose, "v", false, "Print each tarsnap command, and how long it took, to stderr")
+	fs.BoolVar(&o.verbose, "verbose", false, "Same as -v")
+	fs.StringVar(&o.logFormat, "log-format", "text", "Format for log messages on stderr: text or json")
+	fs.StringVar(&o.format, "format", "text", "Format for the plan: text, json or csv. JSON is only printed in dry run mode. In real runs CSV is printed once deletion finishes, with the outcome for each archive")
+	fs.DurationVar(&o.timeout, "timeout", 10*time.Minute, "Kill any single tarsnap command that runs longer than this. 0 means no limit")
+	fs.StringVar(&o.onError, "on-error", "abort", "What to do when a batch can't be deleted: abort, to exit right away, or continue, to carry on with the other batches and exit non-zero at the end")
+	fs.IntVar(&o.maxRetries, "max-retries", 3, "Number of times to retry a delete that fails with a network error")
+	fs.DurationVar(&o.retryDelay, "retry-delay", 5*time.Second, "Time to wait before retrying a failed delete. Doubles with each retry")
+	fs.Float64Var(&o.retryJitter, "retry-jitter", 0.2, "Wait up to this fraction of -retry-delay more or less before each retry, chosen at random, "+
+		"so that deletes that fail at the same time don't all retry at once. 0 turns it off")
+	fs.Int64Var(&o.retryJitterSeed, "retry-jitter-seed", 0, "Seed for the random -retry-jitter, to make retry timing repeatable. 0 means pick one at random")
+	fs.StringVar(&o.metricsAddr, "metrics-addr", "", "Serve Prometheus metrics at /metrics on this address, e.g. localhost:9100, until the run finishes")
+	fs.StringVar(&o.after, "after", "", "Only consider archives created at or after this RFC 3339 time")
+	fs.StringVar(&o.before, "before", "", "Only consider archives created before this RFC 3339 time")
+	fs.BoolVar(&o.strict, "strict", false, "Exit with an error if any archive is dated in the future, instead of skipping it with a warning")
+	fs.StringVar(&o.postHook, "post-hook", "", "Command (and space separated arguments) to run after deleting archives. The counts from the summary are passed in TARSNAP_KEPT, TARSNAP_DELETED, TARSNAP_GONE and TARSNAP_ERRORS. "+
+		"With -no-exec, TARSNAP_DELETED is 0 and the archives that would have been deleted are counted in TARSNAP_SIMULATED")
+	fs.BoolVar(&o.postHookRequired, "post-hook-required", false, "Exit non-zero if the -post-hook command fails")
+	fs.BoolVar(&o.countOnly, "count-only", false, "Print the number of matched archives and the number the plan would discard, separated by a space, and exit without deleting anything")
+	fs.BoolVar(&o.listOnly, "list-only", false, "Print the archives matching -archive-regex and exit, without planning or deleting anything. Deprecated: use the list command")
+	fs.StringVar(&o.planOut, "plan-out", "", "Also write the plan, in -format, to this file. In real runs the file records what actually happened to each archive, even if the run is aborted; archives it didn't get to are still listed as discards. "+
+		"If this is a unix: or tcp: address, like unix:/run/dash.sock, a JSON line is sent there for each archive as soon as the plan is made, and another as each one is deleted")
+	fs.BoolVar(&o.calendar, "calendar", false, "After the plan, print a grid showing how many archives are kept and discarded in each month")
+	fs.StringVar(&o.sortOrder, "sort", "date-asc", "Order of the printed plan: date-asc, date-desc or name. Retention is always computed oldest first")
+	fs.StringVar(&o.deleteNamesFile, "delete-names-file", "", "Delete exactly the archives named in this file, one per line, instead of listing archives and applying the retention policy")
+	fs.StringVar(&o.executePlan, "execute-plan", "", "Delete exactly the archives listed under \"discard\" in this JSON plan, from an earlier -format json dry run, instead of listing archives and applying the retention policy")
+	fs.StringVar(&o.nowFlag, "now", "", "Compute every cutoff as if it were this RFC 3339 time, instead of the current time, for reproducible dry runs")
+	fs.StringVar(&o.previousPlan, "previous-plan", "", "JSON plan from an earlier -format json run. Only archives whose action has changed since then are printed")
+	fs.DurationVar(&o.delay, "delay", 0, "Before each batch of deletes after the first, once -concurrency lets it start, wait this long, to go easy on bandwidth and the tarsnap service. "+
+		"With a -concurrency of 1, that's a wait between one batch finishing and the next starting")
+	fs.BoolVar(&o.printStats, "print-stats", false, "Run deletes with tarsnap --print-stats, and report the space they actually freed in the summary")
+	fs.BoolVar(&o.noExec, "no-exec", false, "Don't run tarsnap to delete archives, just pretend each delete succeeded")
+	fs.DurationVar(&o.simulateLatency, "simulate-latency", 0, "With -no-exec, how long each pretend delete takes")
+	return o
+}
+
+// validate checks for flags that are out of range or can't be used together,
+// fills in flags implied by others, and parses the regular expressions, group
+// paths and times.
+func (o *options) validate() error {
+	switch o.sortOrder {
+	case "date-asc", "date-desc", "name":
+	default:
+		return fmt.Errorf("unknown -sort %q, want date-asc, date-desc or name", o.sortOrder)
+	}
+	if o.format != "text" && o.format != "json" && o.format != "csv" {
+		return fmt.Errorf("unknown -format %q, want text, json or csv", o.format)
+	}
+	if o.simulateLatency != 0 && !o.noExec {
+		return errors.New("-simulate-latency requires -no-exec")
+	}
+	if o.noExec && o.appendDeleted {
+		return errors.New("-no-exec can't be used with -append-deleted, which would record archives that weren't deleted")
+	}
+	if o.reconcile && o.file == "" {
+		return errors.New("-reconcile requires -file")
+	}
+	if o.appendDeleted && o.alreadyDeleted == "" {
+		return errors.New("-append-deleted requires -already-deleted-file")
+	}
+	if o.markDeleted != "" && !o.dryRun {
+		return errors.New("-dry-run-mark-deleted only works with -dry-run")
+	}
+	if o.deleteAllMatching && !o.dryRun && !o.yes {
+		return errors.New("-delete-all-matching requires -yes")
+	}
+	if o.groupByPrefix && o.prefixSeparator == "" {
+		return errors.New("-prefix-separator must not be empty")
+	}
+	if o.targetFree < 0 {
+		return errors.New("-target-free must not be negative")
+	}
+	if o.targetFree > 0 {
+		o.sizes = true
+	}
+	if o.delay < 0 {
+		return errors.New("-delay must not be negative")
+	}
+	if o.concurrency < 1 {
+		return fmt.Errorf("-concurrency must be at least 1, got %d", o.concurrency)
+	}
+	var err error
+	o.groupKeyfileMap, err = parseGroupPaths("group-keyfile", o.groupKeyfiles)
+	if err != nil {
+		return err
+	}
+	o.groupCachedirMap, err = parseGroupPaths("group-cachedir", o.groupCachedirs)
+	if err != nil {
+		return err
+	}
+	if o.batchSize <= 0 {
+		return errors.New("please provide a positive batch size")
+	}
+	if o.keepLatest < 0 {
+		return errors.New("-keep-latest must not be negative")
+	}
+	if o.maxDelete < 0 {
+		return errors.New("-max-delete must not be negative")
+	}
+	if o.onError != "abort" && o.onError != "continue" {
+		return fmt.Errorf("unknown -on-error %q, want abort or continue", o.onError)
+	}
+	if o.maxRetries < 0 {
+		return errors.New("-max-retries must not be negative")
+	}
+	if o.retryJitter < 0 || o.retryJitter > 1 {
+		return fmt.Errorf("-retry-jitter must be between 0 and 1, got %v", o.retryJitter)
+	}
+	if len(o.regexes) == 0 && o.host != "" {
+		o.regexes = stringsFlag{"^.*$"}
+	}
+	if o.executePlan != "" && o.deleteNamesFile != "" {
+		return errors.New("-execute-plan and -delete-names-file can't be used together")
+	}
+	if len(o.regexes) == 0 && o.executePlan == "" && o.deleteNamesFile == "" {
+		return errors.New("please provide archive regex")
+	}
+	o.excludeRxs = make([]*regexp.Regexp, len(o.excludeRegexes))
+	for i := range o.excludeRegexes {
+		o.excludeRxs[i], err = compileArchiveRegex(o.excludeRegexes[i], o.strictRegex, o.ignoreCase)
+		if err != nil {
+			return fmt.Errorf("invalid -exclude-regex: %w", err)
+		}
+	}
+	o.rxs = make([]*regexp.Regexp, len(o.regexes))
+	for i := range o.regexes {
+		o.rxs[i], err = compileArchiveRegex(o.regexes[i], o.strictRegex, o.ignoreCase)
+		if err != nil {
+			return fmt.Errorf("invalid -archive-regex: %w", err)
+		}
+	}
+	if o.after != "" {
+		o.afterTime, err = time.Parse(time.RFC3339, o.after)
+		if err != nil {
+			return fmt.Errorf("invalid -after, want an RFC 3339 time like 2024-01-01T00:00:00Z: %w", err)
+		}
+	}
+	if o.before != "" {
+		o.beforeTime, err = time.Parse(time.RFC3339, o.before)
+		if err != nil {
+			return fmt.Errorf("invalid -before, want an RFC 3339 time like 2024-02-01T00:00:00Z: %w", err)
+		}
+	}
+	if !o.afterTime.IsZero() && !o.beforeTime.IsZero() && !o.afterTime.Before(o.beforeTime) {
+		return fmt.Errorf("-after (%s) must be earlier than -before (%s)", o.after, o.before)
+	}
+	o.now = time.Now()
+	if o.nowFlag != "" {
+		o.now, err = time.Parse(time.RFC3339, o.nowFlag)
+		if err != nil {
+			return fmt.Errorf("invalid -now, want an RFC 3339 time like 2024-06-15T12:00:00Z: %w", err)
+		}
+	}
+	return nil
+}
+
+// policy returns the retention policy set by the flags and any -group-policy,
+// after checking it against o.now.
+func (o *options) policy() (Policy, error) {
+	monthly, err := parseTierAge(o.monthlyAfter)
+	if err != nil {
+		return Policy{}, fmt.Errorf("invalid -monthly-after: %w", err)
+	}
+	weekly, err := parseTierAge(o.weeklyAfter)
+	if err != nil {
+		return Policy{}, fmt.Errorf("invalid -weekly-after: %w", err)
+	}
+	keepAll, err := parseTierAge(o.keepAllAfter)
+	if err != nil {
+		return Policy{}, fmt.Errorf("invalid -keep-all-after: %w", err)
+	}
+	var olderThan *age
+	if o.olderThan != "" {
+		a, err := parseAge(o.olderThan)
+		if err != nil {
+			return Policy{}, fmt.Errorf("invalid -older-than: %w", err)
+		}
+		olderThan = &a
+	}
+	var weekStart *time.Weekday
+	if o.weekStartFlag != "" {
+		d, err := parseWeekday(o.weekStartFlag)
+		if err != nil {
+			return Policy{}, fmt.Errorf("invalid -week-start: %w", err)
+		}
+		weekStart = &d
+	}
+	var daily *age
+	if o.dailyAfter != "" {
+		d, err := parseTierAge(o.dailyAfter)
+		if err != nil {
+			return Policy{}, fmt.Errorf("invalid -daily-after: %w", err)
+		}
+		daily = &d
+		keepAllSet := false
+		o.fs.Visit(func(f *flag.Flag) {
+			keepAllSet = keepAllSet || f.Name == "keep-all-after"
+		})
+		if !keepAllSet {
+			keepAll = d
+		}
+	}
+	var maxAge *age
+	if o.maxAge != "" {
+		a, err := parseAge(o.maxAge)
+		if err != nil {
+			return Policy{}, fmt.Errorf("invalid -max-age: %w", err)
+		}
+		maxAge = &a
+	}
+	minAge, err := parseAge(o.minAge)
+	if err != nil {
+		return Policy{}, fmt.Errorf("invalid -min-age: %w", err)
+	}
+	loc, err := time.LoadLocation(o.timezone)
+	if err != nil {
+		return Policy{}, fmt.Errorf("invalid -timezone: %w", err)
+	}
+	pol := Policy{
+		Name:           o.policyName,
+		MonthlyAfter:   monthly,
+		WeeklyAfter:    weekly,
+		KeepAllAfter:   keepAll,
+		DailyAfter:     daily,
+		WeekStart:      weekStart,
+		CalendarMonths: o.calendarMonths,
+		OlderThan:      olderThan,
+		MaxAge:         maxAge,
+		GFS:            o.gfs,
+		MinAge:         minAge,
+		KeepLatest:     o.keepLatest,
+		Location:       loc,
+	}
+	for _, spec := range o.groupPolicies {
+		group, gp, err := parseGroupPolicy(spec, pol)
+		if err != nil {
+			return Policy{}, fmt.Errorf("invalid -group-policy: %w", err)
+		}
+		if pol.Groups == nil {
+			pol.Groups = make(map[string]Policy)
+		}
+		pol.Groups[group] = gp
+	}
+	if err := pol.validate(o.now); err != nil {
+		return Policy{}, fmt.Errorf("invalid retention policy: %w", err)
+	}
+	return pol, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testOptions parses args into options, the way main does.
+func testOptions(t *testing.T, args ...string) *options {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	o := newOptions(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		args []string
+		// a substring of the error, or "" if the options are valid
+		want string
+	}{
+		{[]string{"-archive-regex", "^web-"}, ""},
+		{[]string{}, "please provide archive regex"},
+		{[]string{"-execute-plan", "plan.json"}, ""},
+		{[]string{"-execute-plan", "plan.json", "-delete-names-file", "names"}, "can't be used together"},
+		{[]string{"-archive-regex", "^web-", "-format", "yaml"}, `unknown -format "yaml"`},
+		{[]string{"-archive-regex", "^web-", "-sort", "size"}, `unknown -sort "size"`},
+		{[]string{"-archive-regex", "^web-", "-on-error", "retry"}, `unknown -on-error "retry"`},
+		{[]string{"-archive-regex", "^web-", "-delete-all-matching", "-dry-run=false"}, "-delete-all-matching requires -yes"},
+		{[]string{"-archive-regex", "^web-", "-delete-all-matching", "-dry-run=false", "-yes"}, ""},
+		{[]string{"-archive-regex", "^web-", "-delete-all-matching"}, ""},
+		{[]string{"-archive-regex", "^web-", "-concurrency", "0"}, "-concurrency must be at least 1"},
+		{[]string{"-archive-regex", "^web-", "-batch-size", "0"}, "positive batch size"},
+		{[]string{"-archive-regex", "^web-", "-retry-jitter", "1.5"}, "-retry-jitter must be between 0 and 1"},
+		{[]string{"-archive-regex", "^web-", "-reconcile"}, "-reconcile requires -file"},
+		{[]string{"-archive-regex", "^web-", "-no-exec", "-append-deleted", "-already-deleted-file", "x"}, "-no-exec can't be used with -append-deleted"},
+		{[]string{"-archive-regex", "^web-", "-simulate-latency", "1s"}, "-simulate-latency requires -no-exec"},
+		{[]string{"-archive-regex", "^web-", "-group-keyfile", "web01"}, "group-keyfile"},
+		{[]string{"-archive-regex", "("}, "invalid -archive-regex"},
+		{[]string{"-archive-regex", "^web-", "-strict-regex"}, "invalid -archive-regex"},
+		{[]string{"-archive-regex", "^web-", "-exclude-regex", "["}, "invalid -exclude-regex"},
+		{[]string{"-archive-regex", "^web-", "-after", "2024-01-01"}, "invalid -after"},
+		{[]string{"-archive-regex", "^web-", "-after", "2024-02-01T00:00:00Z", "-before", "2024-01-01T00:00:00Z"}, "-after (2024-02-01T00:00:00Z) must be earlier than -before"},
+		{[]string{"-archive-regex", "^web-", "-now", "yesterday"}, "invalid -now"},
+	}
+	for _, tt := range tests {
+		err := testOptions(t, tt.args...).validate()
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%q: %v", tt.args, err)
+		case tt.want != "" && err == nil:
+			t.Errorf("%q: got no error, want one containing %q", tt.args, tt.want)
+		case tt.want != "" && !strings.Contains(err.Error(), tt.want):
+			t.Errorf("%q: got error %q, want one containing %q", tt.args, err, tt.want)
+		}
+	}
+}
+
+func TestOptionsValidateFillsInFlags(t *testing.T) {
+	o := testOptions(t, "-host", "db", "-target-free", "1000", "-now", "2024-06-15T12:00:00Z",
+		"-group-cachedir", "db01=/var/cache/db01")
+	if err := o.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(o.regexes, stringsFlag{"^.*$"}) || len(o.rxs) != 1 {
+		t.Errorf("-host without -archive-regex: got regexes %q, want every archive to match", o.regexes)
+	}
+	if !o.sizes {
+		t.Error("-target-free should imply -sizes")
+	}
+	if got := o.now.Format("2006-01-02T15:04:05Z07:00"); got != "2024-06-15T12:00:00Z" {
+		t.Errorf("now = %s, want -now", got)
+	}
+	if want := map[string]string{"db01": "/var/cache/db01"}; !reflect.DeepEqual(o.groupCachedirMap, want) {
+		t.Errorf("group cachedirs = %v, want %v", o.groupCachedirMap, want)
+	}
+}
+
+func TestOptionsPolicy(t *testing.T) {
+	policy := func(args ...string) (Policy, error) {
+		t.Helper()
+		o := testOptions(t, append([]string{"-archive-regex", "^web-", "-timezone", "UTC"}, args...)...)
+		if err := o.validate(); err != nil {
+			t.Fatal(err)
+		}
+		return o.policy()
+	}
+	pol, err := policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pol.Name != "legacy" || pol.MonthlyAfter != (age{years: 2}) || pol.WeeklyAfter != (age{months: 2}) || pol.MinAge != (age{days: 14}) || pol.DailyAfter != nil {
+		t.Errorf("default policy = %+v", pol)
+	}
+	// -daily-after moves -keep-all-after down with it, unless that's set too.
+	pol, err = policy("-daily-after", "7d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pol.DailyAfter == nil || *pol.DailyAfter != (age{days: 7}) || pol.KeepAllAfter != (age{days: 7}) {
+		t.Errorf("-daily-after 7d: got daily %v, keep all %v, want 7d for both", pol.DailyAfter, pol.KeepAllAfter)
+	}
+	pol, err = policy("-daily-after", "7d", "-keep-all-after", "3d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pol.KeepAllAfter != (age{days: 3}) {
+		t.Errorf("-keep-all-after 3d with -daily-after: got keep all %v, want 3d", pol.KeepAllAfter)
+	}
+	pol, err = policy("-group-policy", "db:keep-latest=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pol.Groups["db"].KeepLatest != 5 || pol.KeepLatest != 0 {
+		t.Errorf("-group-policy db:keep-latest=5: got %d for db and %d otherwise", pol.Groups["db"].KeepLatest, pol.KeepLatest)
+	}
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-weekly-after", "2m"}, "invalid -weekly-after"},
+		{[]string{"-monthly-after", "12h"}, "invalid -monthly-after"},
+		{[]string{"-min-age", "soon"}, "invalid -min-age"},
+		{[]string{"-week-start", "someday"}, "invalid -week-start"},
+		{[]string{"-timezone", "Mars/Olympus_Mons"}, "invalid -timezone"},
+		{[]string{"-group-policy", "db:unknown=1"}, "invalid -group-policy"},
+	} {
+		_, err := policy(tt.args...)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got error %v, want one containing %q", tt.args, err, tt.want)
+		}
+	}
+}
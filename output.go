@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// writeTextPlan prints plan to w, one archive per line. Archives that are
+// already gone are always printed; keep and discard decisions are only
+// printed in dry run mode.
+func writeTextPlan(w io.Writer, plan []decision, dryRun bool) {
+	for i := range plan {
+		switch plan[i].Action {
+		case actionGone:
+			fmt.Fprintln(w, "gone   ", plan[i].Item.Name)
+		default:
+			if !dryRun {
+				continue
+			}
+			if g := plan[i].Item.Group; g != "" {
+				fmt.Fprintln(w, plan[i].label(), "group="+g, plan[i].Item.String())
+			} else {
+				fmt.Fprintln(w, plan[i].label(), plan[i].Item.String())
+			}
+		}
+	}
+}
+
+// sortedForDisplay returns a copy of plan in the given order: "date-asc",
+// "date-desc" or "name". plan itself is left in chronological order for the
+// deleter.
+func sortedForDisplay(plan []decision, order string) []decision {
+	sorted := append([]decision(nil), plan...)
+	switch order {
+	case "date-desc":
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].Item.Date.After(sorted[j].Item.Date)
+		})
+	case "name":
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].Item.Name < sorted[j].Item.Name
+		})
+	}
+	return sorted
+}
+
+// writeCalendar prints a grid to w with a row for each year in plan and a
+// column for each month, showing how many archives are kept and discarded
+// that month as "kept/discarded". Undated archives are left out.
+func writeCalendar(w io.Writer, plan []decision) {
+	type counts struct{ keep, discard int }
+	months := make(map[[2]int]*counts)
+	first, last := 0, 0
+	for i := range plan {
+		if plan[i].Action != actionKeep && plan[i].Action != actionDiscard {
+			continue
+		}
+		if plan[i].Item.undated() {
+			// there's no month to count it in
+			continue
+		}
+		d := plan[i].Item.Date
+		key := [2]int{d.Year(), int(d.Month())}
+		c := months[key]
+		if c == nil {
+			c = new(counts)
+			months[key] = c
+		}
+		if plan[i].Action == actionKeep {
+			c.keep++
+		} else {
+			c.discard++
+		}
+		if first == 0 || d.Year() < first {
+			first = d.Year()
+		}
+		if d.Year() > last {
+			last = d.Year()
+		}
+	}
+	if first == 0 {
+		return
+	}
+	fmt.Fprintln(w, "archives kept/discarded by month")
+	fmt.Fprintf(w, "%-6s", "")
+	for m := time.January; m <= time.December; m++ {
+		fmt.Fprintf(w, "%9s", m.String()[:3])
+	}
+	fmt.Fprintln(w)
+	for y := first; y <= last; y++ {
+		fmt.Fprintf(w, "%-6d", y)
+		for m := 1; m <= 12; m++ {
+			if c := months[[2]int{y, m}]; c != nil {
+				fmt.Fprintf(w, "%9s", fmt.Sprintf("%d/%d", c.keep, c.discard))
+			} else {
+				fmt.Fprintf(w, "%9s", "-")
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// withoutGone returns the decisions in plan for archives that aren't already
+// gone.
+func withoutGone(plan []decision) []decision {
+	kept := make([]decision, 0, len(plan))
+	for i := range plan {
+		if plan[i].Action != actionGone {
+			kept = append(kept, plan[i])
+		}
+	}
+	return kept
+}
+
+// keptDecisions returns the decisions in plan for archives that are kept,
+// including the ones kept because they match -exclude-regex.
+func keptDecisions(plan []decision) []decision {
+	kept := make([]decision, 0, len(plan))
+	for i := range plan {
+		if plan[i].Action == actionKeep || plan[i].Action == actionExcluded {
+			kept = append(kept, plan[i])
+		}
+	}
+	return kept
+}
+
+type jsonEntry struct {
+	Name   string    `json:"name"`
+	Date   time.Time `json:"date"`
+	Action string    `json:"action,omitempty"`
+	Size   int64     `json:"size,omitempty"`
+	Group  string    `json:"group,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type jsonSummary struct {
+	Keep     int `json:"keep"`
+	Discard  int `json:"discard"`
+	Gone     int `json:"gone"`
+	Excluded int `json:"excluded"`
+	Failed   int `json:"failed,omitempty"`
+}
+
+type jsonPlan struct {
+	Keep     []jsonEntry `json:"keep"`
+	Discard  []jsonEntry `json:"discard"`
+	Gone     []jsonEntry `json:"gone"`
+	Excluded []jsonEntry `json:"excluded"`
+	Failed   []jsonEntry `json:"failed,omitempty"`
+	Summary  jsonSummary `json:"summary"`
+}
+
+// writeJSONPlan writes plan to w as a single JSON object. Entries are sorted
+// by date, then name, so that plans from different runs can be diffed.
+func writeJSONPlan(w io.Writer, plan []decision) error {
+	p := jsonPlan{
+		Keep:     make([]jsonEntry, 0),
+		Discard:  make([]jsonEntry, 0),
+		Gone:     make([]jsonEntry, 0),
+		Excluded: make([]jsonEntry, 0),
+	}
+	for i := range plan {
+		e := jsonEntry{
+			Name:   plan[i].Item.Name,
+			Date:   plan[i].Item.Date,
+			Action: plan[i].Action,
+			Size:   plan[i].Item.Size,
+			Group:  plan[i].Item.Group,
+			Reason: plan[i].Reason,
+		}
+		switch plan[i].Action {
+		case actionKeep:
+			p.Keep = append(p.Keep, e)
+		case actionDiscard:
+			p.Discard = append(p.Discard, e)
+		case actionGone:
+			p.Gone = append(p.Gone, e)
+		case actionExcluded:
+			p.Excluded = append(p.Excluded, e)
+		case actionFailed:
+			p.Failed = append(p.Failed, e)
+		}
+	}
+	for _, entries := range [][]jsonEntry{p.Keep, p.Discard, p.Gone, p.Excluded, p.Failed} {
+		sort.Slice(entries, func(i, j int) bool {
+			if !entries[i].Date.Equal(entries[j].Date) {
+				return entries[i].Date.Before(entries[j].Date)
+			}
+			return entries[i].Name < entries[j].Name
+		})
+	}
+	p.Summary = jsonSummary{
+		Keep:     len(p.Keep),
+		Discard:  len(p.Discard),
+		Gone:     len(p.Gone),
+		Excluded: len(p.Excluded),
+		Failed:   len(p.Failed),
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// writeJSONList writes items to w as a JSON array, in order.
+func writeJSONList(w io.Writer, items []*archiveItem) error {
+	entries := make([]jsonEntry, len(items))
+	for i := range items {
+		entries[i] = jsonEntry{
+			Name:  items[i].Name,
+			Date:  items[i].Date,
+			Size:  items[i].Size,
+			Group: items[i].Group,
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+// writeCSVPlan writes plan to w as CSV, with a header row followed by one
+// row per archive, in order.
+func writeCSVPlan(w io.Writer, plan []decision) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "date", "action", "group", "reason"})
+	for i := range plan {
+		item := plan[i].Item
+		cw.Write([]string{item.Name, item.Date.Format("2006-01-02 15:04:05"), plan[i].Action, item.Group, plan[i].Reason})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeCSVList writes items to w as CSV in the same layout as writeCSVPlan,
+// with an empty action column.
+func writeCSVList(w io.Writer, items []*archiveItem) error {
+	plan := make([]decision, len(items))
+	for i := range items {
+		plan[i] = decision{Item: items[i]}
+	}
+	return writeCSVPlan(w, plan)
+}
+
+// A runSummary is written to -summary-out at the end of a run.
+type runSummary struct {
+	DryRun          bool     `json:"dry_run"`
+	Kept            int64    `json:"kept"`
+	Discarded       int64    `json:"discarded"`
+	Gone            int64    `json:"gone"`
+	Errors          int64    `json:"errors"`
+	FreedBytes      int64    `json:"freed_bytes,omitempty"`
+	FailedArchives  []string `json:"failed_archives"`
+	DurationSeconds float64  `json:"duration_seconds"`
+	// the reason the run stopped early, if it did
+	Error string `json:"error,omitempty"`
+}
+
+func newRunSummary(stats *runStats, start time.Time, dryRun bool, msg string) runSummary {
+	return runSummary{
+		DryRun:          dryRun,
+		Kept:            stats.kept.Load(),
+		Discarded:       stats.discarded.Load(),
+		Gone:            stats.gone.Load(),
+		Errors:          stats.errors.Load(),
+		FreedBytes:      stats.freed.Load(),
+		FailedArchives:  make([]string, 0),
+		DurationSeconds: time.Since(start).Seconds(),
+		Error:           msg,
+	}
+}
+
+// writeRunSummary writes s to the named file as JSON.
+func writeRunSummary(name string, s runSummary) error {
+	if s.FailedArchives == nil {
+		s.FailedArchives = make([]string, 0)
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0644)
+}
+
+// readJSONPlan reads a plan written by writeJSONPlan and returns the action
+// for each archive in it.
+func readJSONPlan(r io.Reader) (map[string]string, error) {
+	var p jsonPlan
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, err
+	}
+	actions := make(map[string]string)
+	for _, entries := range [][]jsonEntry{p.Keep, p.Discard, p.Gone, p.Excluded, p.Failed} {
+		for _, e := range entries {
+			actions[e.Name] = e.Action
+		}
+	}
+	return actions, nil
+}
+
+// readExecutablePlan reads a plan written by writeJSONPlan, for
+// -execute-plan, and returns its decisions sorted by date. It is stricter
+// than readJSONPlan, since the plan decides what gets deleted: unknown
+// fields, entries with no name or date, entries under the wrong action,
+// archives listed twice and a summary that doesn't add up are all errors.
+func readExecutablePlan(r io.Reader) ([]decision, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var p jsonPlan
+	if err := dec.Decode(&p); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after the plan")
+	}
+	if p.Discard == nil {
+		return nil, errors.New(`plan has no "discard" list`)
+	}
+	want := jsonSummary{len(p.Keep), len(p.Discard), len(p.Gone), len(p.Excluded), len(p.Failed)}
+	if p.Summary != want {
+		return nil, fmt.Errorf("plan summary %+v doesn't match its entries %+v", p.Summary, want)
+	}
+	plan := make([]decision, 0)
+	seen := make(map[string]bool)
+	for _, section := range []struct {
+		action  string
+		entries []jsonEntry
+	}{
+		{actionKeep, p.Keep},
+		{actionDiscard, p.Discard},
+		{actionGone, p.Gone},
+		{actionExcluded, p.Excluded},
+		{actionFailed, p.Failed},
+	} {
+		for _, e := range section.entries {
+			switch {
+			case e.Name == "":
+				return nil, fmt.Errorf("%s entry with no name", section.action)
+			case e.Date.IsZero() && e.Reason != "undated" && e.Reason != "named":
+				// Only archives from a listing without dates, and ones
+				// named by -delete-names-file, have no date.
+				return nil, fmt.Errorf("%s entry %q has no date", section.action, e.Name)
+			case e.Action != section.action:
+				return nil, fmt.Errorf("entry %q has action %q but is listed under %q", e.Name, e.Action, section.action)
+			case seen[e.Name]:
+				return nil, fmt.Errorf("archive %q is listed more than once", e.Name)
+			}
+			seen[e.Name] = true
+			item := &archiveItem{Name: e.Name, Date: e.Date, Size: e.Size, Group: e.Group}
+			plan = append(plan, decision{item, section.action, e.Reason})
+		}
+	}
+	sortByDate(plan)
+	return plan, nil
+}
+
+// changedSince returns the decisions in plan whose action is different from
+// the one in prev, including archives that prev doesn't know about.
+func changedSince(plan []decision, prev map[string]string) []decision {
+	changed := make([]decision, 0)
+	for i := range plan {
+		if action, ok := prev[plan[i].Item.Name]; !ok || action != plan[i].Action {
+			changed = append(changed, plan[i])
+		}
+	}
+	return changed
+}
+
+// writePlanFile writes every decision in plan to the named file in format.
+// The plan is written to a temporary file that is renamed into place once
+// it is complete, so an interrupted run never leaves a partial plan behind.
+func writePlanFile(name, format string, plan []decision) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	switch format {
+	case "json":
+		err = writeJSONPlan(tmp, plan)
+	case "csv":
+		err = writeCSVPlan(tmp, plan)
+	default:
+		writeTextPlan(tmp, plan, true)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadExecutablePlan(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+	plan := []decision{
+		{&archiveItem{Name: "a", Date: day(1), Size: 10, Group: "db"}, actionDiscard, ""},
+		{&archiveItem{Name: "b", Date: day(2)}, actionKeep, "monthly"},
+		{&archiveItem{Name: "c", Date: day(3)}, actionGone, ""},
+		{&archiveItem{Name: "d", Date: day(4)}, actionExcluded, ""},
+		{&archiveItem{Name: "e", Date: day(5)}, actionFailed, ""},
+	}
+	var buf bytes.Buffer
+	if err := writeJSONPlan(&buf, plan); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readExecutablePlan(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, plan) {
+		t.Errorf("got %v, want %v", got, plan)
+	}
+
+	const entry = `{"name": "a", "date": "2020-01-01T00:00:00Z", "action": "discard"}`
+	const summary = `"summary": {"keep": 0, "discard": 1, "gone": 0, "excluded": 0}`
+	tests := []struct {
+		name, plan string
+	}{
+		{"wrong action", `{"discard": [{"name": "a", "date": "2020-01-01T00:00:00Z", "action": "keep"}], ` + summary + `}`},
+		{"unknown action", `{"discard": [{"name": "a", "date": "2020-01-01T00:00:00Z", "action": "delete"}], ` + summary + `}`},
+		{"missing name", `{"discard": [{"date": "2020-01-01T00:00:00Z", "action": "discard"}], ` + summary + `}`},
+		{"unknown entry field", `{"discard": [{"name": "a", "date": "2020-01-01T00:00:00Z", "action": "discard", "force": true}], ` + summary + `}`},
+		{"unknown plan field", `{"discard": [` + entry + `], "delete": [], ` + summary + `}`},
+		{"no discard list", `{` + strings.Replace(summary, `"discard": 1`, `"discard": 0`, 1) + `}`},
+		{"summary doesn't match", `{"discard": [` + entry + `, {"name": "b", "date": "2020-01-02T00:00:00Z", "action": "discard"}], ` + summary + `}`},
+		{"listed twice", `{"discard": [` + entry + `], "gone": [{"name": "a", "date": "2020-01-01T00:00:00Z", "action": "gone"}], "summary": {"keep": 0, "discard": 1, "gone": 1, "excluded": 0}}`},
+		{"trailing data", `{"discard": [` + entry + `], ` + summary + `} {}`},
+	}
+	for _, tt := range tests {
+		if _, err := readExecutablePlan(strings.NewReader(tt.plan)); err == nil {
+			t.Errorf("%s: expected an error, got nil", tt.name)
+		}
+	}
+	// the same plan, with nothing wrong, is fine
+	if _, err := readExecutablePlan(strings.NewReader(`{"discard": [` + entry + `], ` + summary + `}`)); err != nil {
+		t.Errorf("valid plan: %v", err)
+	}
+}
+
+func TestExecutablePlanUndatedRoundTrip(t *testing.T) {
+	plan := []decision{
+		{&archiveItem{Name: "undated-1"}, actionKeep, "undated"},
+		{&archiveItem{Name: "named-1"}, actionDiscard, "named"},
+		{&archiveItem{Name: "named-2"}, actionGone, "named"},
+		{&archiveItem{Name: "dated-1", Date: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}, actionDiscard, ""},
+	}
+	var buf bytes.Buffer
+	if err := writeJSONPlan(&buf, plan); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readExecutablePlan(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := make(map[string]string)
+	for _, d := range got {
+		actions[d.Item.Name] = d.label()
+	}
+	for _, d := range plan {
+		if actions[d.Item.Name] != d.label() {
+			t.Errorf("%s: got %q, want %q", d.Item.Name, actions[d.Item.Name], d.label())
+		}
+	}
+	// Any other entry with no date is still a mistake.
+	buf.Reset()
+	if err := writeJSONPlan(&buf, []decision{{&archiveItem{Name: "a"}, actionDiscard, ""}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readExecutablePlan(&buf); err == nil {
+		t.Error("expected an error for a discard entry with no date, got nil")
+	}
+}
+
+func TestWriteCalendarSkipsUndated(t *testing.T) {
+	plan := []decision{
+		{&archiveItem{Name: "undated-1"}, actionKeep, "undated"},
+		{&archiveItem{Name: "a", Date: time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)}, actionKeep, "monthly"},
+		{&archiveItem{Name: "b", Date: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)}, actionDiscard, ""},
+	}
+	var buf bytes.Buffer
+	writeCalendar(&buf, plan)
+	// a header, the months, and one row each for 2020 and 2021
+	if lines := strings.Count(buf.String(), "\n"); lines != 4 {
+		t.Errorf("got %d lines, want 4:\n%s", lines, buf.String())
+	}
+}
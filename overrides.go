@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseGroupPolicy parses a -group-policy value, which looks like
+//
+//	web01:monthly-after=1y,weekly-after=1mo
+//
+// and returns the group it names and a copy of base with the settings
+// applied. The keys are the names of the retention flags. The group may be
+// written as host=web01 or group=web01 too.
+func parseGroupPolicy(spec string, base Policy) (string, Policy, error) {
+	i := strings.LastIndexByte(spec, ':')
+	if i < 0 {
+		return "", Policy{}, fmt.Errorf("invalid -group-policy %q: want GROUP:KEY=VALUE[,KEY=VALUE...]", spec)
+	}
+	group, settings := spec[:i], spec[i+1:]
+	for _, prefix := range []string{"host=", "group="} {
+		group = strings.TrimPrefix(group, prefix)
+	}
+	if group == "" || settings == "" {
+		return "", Policy{}, fmt.Errorf("invalid -group-policy %q: want GROUP:KEY=VALUE[,KEY=VALUE...]", spec)
+	}
+	p := base
+	p.Groups = nil
+	keepAllSet, dailySet := false, false
+	for _, setting := range strings.Split(settings, ",") {
+		key, val, ok := strings.Cut(setting, "=")
+		if !ok {
+			return "", Policy{}, fmt.Errorf("invalid -group-policy %q: %q is not KEY=VALUE", spec, setting)
+		}
+		var err error
+		switch key {
+		case "policy":
+			p.Name = val
+		case "monthly-after":
+			p.MonthlyAfter, err = parseTierAge(val)
+		case "weekly-after":
+			p.WeeklyAfter, err = parseTierAge(val)
+		case "keep-all-after":
+			p.KeepAllAfter, err = parseTierAge(val)
+			keepAllSet = true
+		case "daily-after":
+			var a age
+			a, err = parseTierAge(val)
+			p.DailyAfter = &a
+			dailySet = true
+		case "week-start":
+			var d time.Weekday
+			d, err = parseWeekday(val)
+			p.WeekStart = &d
+		case "calendar-months":
+			p.CalendarMonths, err = strconv.ParseBool(val)
+		case "older-than":
+			var a age
+			a, err = parseAge(val)
+			p.OlderThan = &a
+		case "max-age":
+			var a age
+			a, err = parseAge(val)
+			p.MaxAge = &a
+		case "min-age":
+			p.MinAge, err = parseAge(val)
+		case "keep-latest":
+			p.KeepLatest, err = strconv.Atoi(val)
+		case "daily":
+			p.GFS.daily, err = strconv.Atoi(val)
+		case "weekly":
+			p.GFS.weekly, err = strconv.Atoi(val)
+		case "monthly":
+			p.GFS.monthly, err = strconv.Atoi(val)
+		case "yearly":
+			p.GFS.yearly, err = strconv.Atoi(val)
+		default:
+			return "", Policy{}, fmt.Errorf("invalid -group-policy %q: unknown setting %q", spec, key)
+		}
+		if err != nil {
+			return "", Policy{}, fmt.Errorf("invalid -group-policy %q: %s: %v", spec, key, err)
+		}
+	}
+	// as with the flags, -daily-after moves -keep-all-after with it
+	if dailySet && !keepAllSet {
+		p.KeepAllAfter = *p.DailyAfter
+	}
+	return group, p, nil
+}
+
+// parseGroupPaths parses the values of -group-keyfile or -group-cachedir,
+// which look like web01=/root/web01.key, into a map from group to path.
+func parseGroupPaths(flagName string, specs []string) (map[string]string, error) {
+	paths := make(map[string]string)
+	for _, spec := range specs {
+		group, path, ok := strings.Cut(spec, "=")
+		if !ok || group == "" || path == "" {
+			return nil, fmt.Errorf("invalid -%s %q: want GROUP=PATH", flagName, spec)
+		}
+		if _, ok := paths[group]; ok {
+			return nil, fmt.Errorf("invalid -%s %q: group %q is given more than once", flagName, spec, group)
+		}
+		paths[group] = path
+	}
+	return paths, nil
+}
+
+// checkConcurrentGroups returns an error unless every group of the archives
+// in items has its own key file and cache directory, for -concurrency above
+// 1. Tarsnap doesn't allow concurrent operations with one key and cache
+// directory, and archives in the same group are never deleted at once.
+func checkConcurrentGroups(items []*archiveItem, keyfiles, cachedirs map[string]string) error {
+	keyfileGroup := make(map[string]string)
+	cachedirGroup := make(map[string]string)
+	for _, item := range items {
+		g := item.Group
+		keyfile, cachedir := keyfiles[g], cachedirs[g]
+		if keyfile == "" || cachedir == "" {
+			return fmt.Errorf("archive %q is in group %q, which has no -group-keyfile and -group-cachedir", item.Name, g)
+		}
+		if other, ok := keyfileGroup[keyfile]; ok && other != g {
+			return fmt.Errorf("groups %q and %q have the same -group-keyfile", other, g)
+		}
+		if other, ok := cachedirGroup[cachedir]; ok && other != g {
+			return fmt.Errorf("groups %q and %q have the same -group-cachedir", other, g)
+		}
+		keyfileGroup[keyfile], cachedirGroup[cachedir] = g, g
+	}
+	return nil
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Policy decides which archives to keep.
+type Policy struct {
+	// Name is "legacy" for the tiers below, or "gfs" for
+	// grandfather-father-son retention.
+	Name string
+	// Archives older than MonthlyAfter are thinned to one per month, and
+	// archives older than WeeklyAfter to one per week. Archives newer than
+	// KeepAllAfter are all kept, even if they are older than WeeklyAfter.
+	MonthlyAfter age
+	WeeklyAfter  age
+	KeepAllAfter age
+	// If DailyAfter is not nil, archives older than it, but newer than
+	// WeeklyAfter, are thinned to the first archive of each calendar day.
+	DailyAfter *age
+	// If WeekStart is not nil, the weekly tier keeps the first archive of
+	// each calendar week, starting on this day, instead of one archive every
+	// seven days.
+	WeekStart *time.Weekday
+	// If CalendarMonths is true, the monthly tier keeps the first archive of
+	// each calendar month, instead of one archive a month after the last one
+	// it kept.
+	CalendarMonths bool
+	// The number of archives to keep in each period, for the gfs policy.
+	GFS gfsCounts
+	// If OlderThan is not nil, it replaces the policy named by Name:
+	// archives older than it are discarded and the rest are kept.
+	OlderThan *age
+	// If MaxAge is not nil, archives older than it are discarded, whatever
+	// tier they are in.
+	MaxAge *age
+	// Archives newer than MinAge are never discarded, whatever the policy
+	// says.
+	MinAge age
+	// The KeepLatest most recent archives in each group are always kept.
+	KeepLatest int
+	// The time zone that tier boundaries are computed in. If nil, the
+	// location of now is used.
+	Location *time.Location
+	// Groups holds the policies to use instead of this one for particular
+	// groups of archives, keyed by group name. Their own Groups are
+	// ignored.
+	Groups map[string]Policy
+}
+
+// forGroup returns the policy for the named group of archives.
+func (p Policy) forGroup(group string) Policy {
+	if gp, ok := p.Groups[group]; ok {
+		return gp
+	}
+	return p
+}
+
+func (p Policy) location(now time.Time) *time.Location {
+	if p.Location == nil {
+		return now.Location()
+	}
+	return p.Location
+}
+
+// validate returns an error if p doesn't make sense.
+func (p Policy) validate(now time.Time) error {
+	switch p.Name {
+	case "legacy":
+		t := p.tiers(now)
+		if t.monthly.After(t.weekly) {
+			return errors.New("-monthly-after must not be shorter than -weekly-after")
+		}
+		if p.DailyAfter != nil && t.daily.Before(t.weekly) {
+			return errors.New("-daily-after must not be longer than -weekly-after")
+		}
+	case "gfs":
+		c := p.GFS
+		if c.daily < 0 || c.weekly < 0 || c.monthly < 0 || c.yearly < 0 {
+			return errors.New("-daily, -weekly, -monthly and -yearly must not be negative")
+		}
+	default:
+		return errors.New("unknown policy " + p.Name + ", want legacy or gfs")
+	}
+	if p.MaxAge != nil && !p.MaxAge.before(now).Before(p.MinAge.before(now)) {
+		return errors.New("-max-age must be longer than -min-age")
+	}
+	for group, gp := range p.Groups {
+		gp.Groups = nil
+		if err := gp.validate(now); err != nil {
+			return fmt.Errorf("-group-policy for %q: %w", group, err)
+		}
+	}
+	return nil
+}
+
+// decide applies p to items, which must be sorted by date, as of now.
+// Retention is applied to each group of items separately. Archives listed in
+// alreadyDeleted are marked as gone, and archives dated after now are skipped
+// with a warning.
+func (p Policy) decide(items []*archiveItem, now time.Time, alreadyDeleted map[string]bool) []decision {
+	items, future := splitFuture(items, now)
+	for _, item := range future {
+		slog.Warn("skipping archive dated in the future", "archive", item.Name, "date", item.Date)
+	}
+	plan := planByGroup(items, func(items []*archiveItem) []decision {
+		if len(items) == 0 {
+			return nil
+		}
+		// every archive in items is in the same group
+		p := p.forGroup(items[0].Group)
+		var plan []decision
+		switch {
+		case p.OlderThan != nil:
+			plan = planOlderThan(items, p.OlderThan.before(now), alreadyDeleted)
+		case p.Name == "gfs":
+			plan = planGFS(items, p.GFS, alreadyDeleted)
+		default:
+			plan = planRetention(items, p.tiers(now), alreadyDeleted)
+		}
+		if p.MaxAge != nil {
+			discardBefore(plan, p.MaxAge.before(now))
+		}
+		keepLatest(plan, p.KeepLatest)
+		return plan
+	})
+	p.keepMinAge(plan, now)
+	return plan
+}
+
+// keepMinAge keeps the archives in plan that are newer than the MinAge of
+// their group's policy as of now, whatever else plan says.
+func (p Policy) keepMinAge(plan []decision, now time.Time) {
+	for i := range plan {
+		minAgeCutoff := p.forGroup(plan[i].Item.Group).MinAge.before(now)
+		if plan[i].Action == actionDiscard && plan[i].Item.Date.After(minAgeCutoff) {
+			slog.Info("kept by -min-age", "archive", plan[i].Item.Name)
+			plan[i].Action = actionKeep
+			plan[i].Reason = "min-age"
+		}
+	}
+}
+
+// planOlderThan discards the archives in items created before cutoff and
+// keeps the rest. Archives listed in alreadyDeleted are marked as gone.
+func planOlderThan(items []*archiveItem, cutoff time.Time, alreadyDeleted map[string]bool) []decision {
+	plan := make([]decision, len(items))
+	for i := range items {
+		switch {
+		case alreadyDeleted[items[i].Name]:
+			plan[i] = decision{items[i], actionGone, ""}
+		case items[i].Date.Before(cutoff):
+			plan[i] = decision{items[i], actionDiscard, ""}
+		default:
+			plan[i] = decision{items[i], actionKeep, "recent"}
+		}
+	}
+	return plan
+}
+
+// discardAll discards every one of items, ignoring the retention policy.
+// Archives listed in alreadyDeleted are marked as gone.
+func discardAll(items []*archiveItem, alreadyDeleted map[string]bool) []decision {
+	plan := make([]decision, len(items))
+	for i := range items {
+		if alreadyDeleted[items[i].Name] {
+			plan[i] = decision{items[i], actionGone, ""}
+		} else {
+			plan[i] = decision{items[i], actionDiscard, ""}
+		}
+	}
+	return plan
+}
+
+// splitFuture splits items into those dated at or before now and those dated
+// after it. A future date usually means clock skew or a corrupted listing, and
+// planning such an archive would mask the problem by filing it under "keep
+// all".
+func splitFuture(items []*archiveItem, now time.Time) (past, future []*archiveItem) {
+	past = make([]*archiveItem, 0, len(items))
+	for _, item := range items {
+		if item.Date.After(now) {
+			future = append(future, item)
+		} else {
+			past = append(past, item)
+		}
+	}
+	return past, future
+}
+
+// Plan applies policy to items, which must be sorted by date, as of now, and
+// returns the archives to keep and the archives to discard. Archives dated
+// after now are in neither.
+func Plan(items []*archiveItem, policy Policy, now time.Time) (keep, discard []*archiveItem) {
+	keep = make([]*archiveItem, 0)
+	discard = make([]*archiveItem, 0)
+	for _, d := range policy.decide(items, now, nil) {
+		if d.Action == actionDiscard {
+			discard = append(discard, d.Item)
+		} else {
+			keep = append(keep, d.Item)
+		}
+	}
+	return keep, discard
+}
+
+// The actions a plan can take for an archive.
+const (
+	actionKeep    = "keep"
+	actionDiscard = "discard"
+	actionGone    = "gone"
+	// kept because it matched -exclude-regex
+	actionExcluded = "excluded"
+	// tarsnap failed to delete the archive
+	actionFailed = "failed"
+)
+
+// A decision records what the plan will do with a single archive.
+type decision struct {
+	Item   *archiveItem
+	Action string
+	// For archives that are kept, the rule that kept them: a tier such as
+	// "monthly" or "all", "latest" for -keep-latest or "min-age". Archives
+	// named by -delete-names-file have the reason "named".
+	Reason string
+}
+
+// label returns d's action, with the reason for keeping the archive if there
+// is one, like "keep[monthly]".
+func (d decision) label() string {
+	if d.Reason == "" {
+		return d.Action
+	}
+	return d.Action + "[" + d.Reason + "]"
+}
+
+// tiers returns the boundaries of p's legacy retention tiers as of now.
+func (p Policy) tiers(now time.Time) tiers {
+	loc := p.location(now)
+	t := newTiers(now, loc, p.MonthlyAfter, p.WeeklyAfter, p.KeepAllAfter)
+	if p.DailyAfter != nil {
+		t.daily = p.DailyAfter.before(startOfDay(now, loc))
+	}
+	t.weekStart = p.WeekStart
+	t.calendarMonths = p.CalendarMonths
+	return t
+}
+
+// logCutoffs logs the time zone that archive dates are read in, now, and the
+// cutoffs that p computes from it, so the time handling can be checked.
+func (p Policy) logCutoffs(now time.Time, group string) {
+	loc := p.location(now)
+	args := []any{"timezone", loc.String(), "system_timezone", now.Local().Format("MST -07:00"), "now", now.In(loc)}
+	if group != "" {
+		args = append(args, "group", group)
+	}
+	switch {
+	case p.OlderThan != nil:
+		args = append(args, "policy", "older-than", "discard_before", p.OlderThan.before(now).In(loc))
+	case p.Name == "gfs":
+		// gfs periods are calendar days, ISO weeks, months and years in loc
+		args = append(args, "policy", "gfs", "today_starts", startOfDay(now, loc))
+	default:
+		t := p.tiers(now)
+		args = append(args, "policy", p.Name, "monthly_before", t.monthly, "weekly_before", t.weekly)
+		if !t.daily.IsZero() {
+			args = append(args, "daily_before", t.daily)
+		}
+		args = append(args, "keep_all_after", t.keepAll)
+		if t.weekStart != nil {
+			args = append(args, "week_start", t.weekStart.String())
+		}
+		if t.calendarMonths {
+			args = append(args, "calendar_months", true)
+		}
+	}
+	if p.MaxAge != nil {
+		args = append(args, "max_age_before", p.MaxAge.before(now).In(loc))
+	}
+	if p.MinAge != (age{}) {
+		args = append(args, "min_age_after", p.MinAge.before(now).In(loc))
+	}
+	slog.Info("retention cutoffs", args...)
+}
+
+// tiers holds the boundaries between retention tiers. Archives older than
+// monthly are thinned to one per month, archives older than weekly to one per
+// week, archives older than daily (if it is set) to one per day, and archives
+// newer than keepAll are all kept. If weekStart is not nil, weeks are
+// calendar weeks starting on that day, and if calendarMonths is true, months
+// are calendar months.
+type tiers struct {
+	monthly        time.Time
+	weekly         time.Time
+	daily          time.Time
+	keepAll        time.Time
+	weekStart      *time.Weekday
+	calendarMonths bool
+}
+
+// monthEnd returns the end of the month that begins with an archive created
+// at d: the same day of the next month or, if t.calendarMonths is set, the
+// first of the next month.
+func (t tiers) monthEnd(d time.Time) time.Time {
+	if !t.calendarMonths {
+		return addMonths(d, 1)
+	}
+	return time.Date(d.Year(), d.Month()+1, 1, 0, 0, 0, 0, d.Location())
+}
+
+// weekEnd returns the end of the week that begins with an archive created at
+// d: seven days later or, if t.weekStart is set, the start of the next
+// calendar week.
+func (t tiers) weekEnd(d time.Time) time.Time {
+	if t.weekStart == nil {
+		return d.AddDate(0, 0, 7)
+	}
+	return startOfWeek(d, *t.weekStart).AddDate(0, 0, 7)
+}
+
+// startOfWeek returns midnight at the start of the calendar week, beginning
+// on start, that contains t, in t's location.
+func startOfWeek(t time.Time, start time.Weekday) time.Time {
+	day := startOfDay(t, t.Location())
+	return day.AddDate(0, 0, -((int(day.Weekday()) - int(start) + 7) % 7))
+}
+
+// parseWeekday parses the name of a day of the week, such as "monday" or
+// "Mon".
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(s, d.String()) || strings.EqualFold(s, d.String()[:3]) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q, want a day such as monday or mon", s)
+}
+
+// startOfDay returns midnight at the start of now's day in loc.
+func startOfDay(now time.Time, loc *time.Location) time.Time {
+	now = now.In(loc)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+}
+
+// newTiers returns the tier boundaries for the given ages. Ages are measured
+// back from midnight at the start of now's day in loc.
+func newTiers(now time.Time, loc *time.Location, monthly, weekly, keepAll age) tiers {
+	today := startOfDay(now, loc)
+	return tiers{
+		monthly: monthly.before(today),
+		weekly:  weekly.before(today),
+		keepAll: keepAll.before(today),
+	}
+}
+
+// planRetention walks items, which must be sorted by date, and decides which
+// ones the retention tiers need to keep. Archives listed in alreadyDeleted
+// are marked as gone. Decisions are returned in the same order as items.
+func planRetention(items []*archiveItem, t tiers, alreadyDeleted map[string]bool) []decision {
+	plan := make([]decision, 0, len(items))
+	currentIndex := 0
+	for currentIndex < len(items) {
+		if alreadyDeleted[items[currentIndex].Name] {
+			plan = append(plan, decision{items[currentIndex], actionGone, ""})
+			currentIndex++
+			continue
+		}
+		item := items[currentIndex]
+		periodStart := item.Date
+		currentIndex++
+		// older than -monthly-after, one archive per month, or per calendar
+		// month with -calendar-months
+		// between -monthly-after and -weekly-after, one per week, or per
+		// calendar week with -week-start
+		// between -weekly-after and -daily-after, one per calendar day
+		// newer than -keep-all-after, all
+		//
+		// The archive is kept for the tier whose period is used, which
+		// isn't always the one it is dated in: an archive less than a month
+		// before -monthly-after starts a weekly period, and one less than a
+		// week before -weekly-after doesn't start one at all.
+		var periodEnd time.Time
+		tier := "all"
+		if periodStart.After(t.keepAll) {
+			// keep everything
+		} else if end := t.monthEnd(periodStart); end.Before(t.monthly) {
+			periodEnd, tier = end, "monthly"
+		} else if end := t.weekEnd(periodStart); end.Before(t.weekly) {
+			periodEnd, tier = end, "weekly"
+		} else if !t.daily.IsZero() {
+			// the rest of the archive's day, once the whole day is older
+			// than -daily-after
+			if end := startOfDay(periodStart, periodStart.Location()).AddDate(0, 0, 1); !end.After(t.daily) {
+				periodEnd, tier = end, "daily"
+			}
+		}
+		plan = append(plan, decision{item, actionKeep, tier})
+		if periodEnd.IsZero() {
+			continue
+		}
+		for currentIndex < len(items) {
+			if alreadyDeleted[items[currentIndex].Name] {
+				plan = append(plan, decision{items[currentIndex], actionGone, ""})
+				currentIndex++
+				continue
+			}
+			// A period that started before -keep-all-after doesn't thin
+			// the archives after it.
+			if d := items[currentIndex].Date; d.Before(periodEnd) && !d.After(t.keepAll) {
+				plan = append(plan, decision{items[currentIndex], actionDiscard, ""})
+				currentIndex++
+				continue
+			}
+			// keep the next item, which is outside the period.
+			break
+		}
+	}
+	return plan
+}
+
+// discardBefore discards the archives in plan that are dated before cutoff,
+// for -max-age.
+func discardBefore(plan []decision, cutoff time.Time) {
+	for i := range plan {
+		if plan[i].Action == actionKeep && plan[i].Item.Date.Before(cutoff) {
+			plan[i].Action = actionDiscard
+			plan[i].Reason = "max-age"
+		}
+	}
+}
+
+// keepNewestPerGroup makes sure that the newest archive in each group of
+// plan, which must be sorted by date, is kept, whatever else plan says.
+// Archives that are already gone don't count.
+func keepNewestPerGroup(plan []decision) {
+	seen := make(map[string]bool)
+	for i := len(plan) - 1; i >= 0; i-- {
+		g := plan[i].Item.Group
+		if seen[g] || plan[i].Action == actionGone {
+			continue
+		}
+		seen[g] = true
+		if plan[i].Action == actionDiscard {
+			slog.Info("kept by -keep-newest-per-group", "archive", plan[i].Item.Name, "group", g)
+			plan[i].Action = actionKeep
+			plan[i].Reason = "newest-in-group"
+		}
+	}
+}
+
+// keepLatest changes the n most recent decisions in plan, which must be
+// sorted by date, to keep. Archives that are already gone don't count.
+func keepLatest(plan []decision, n int) {
+	for i := len(plan) - 1; i >= 0 && n > 0; i-- {
+		switch plan[i].Action {
+		case actionGone:
+			continue
+		case actionDiscard:
+			slog.Info("kept by -keep-latest", "archive", plan[i].Item.Name)
+			plan[i].Action = actionKeep
+			plan[i].Reason = "latest"
+		}
+		n--
+	}
+}
+
+// planByGroup splits items into groups by their Group, runs planner on each
+// group, and returns all of the decisions sorted by date.
+func planByGroup(items []*archiveItem, planner func([]*archiveItem) []decision) []decision {
+	groups := make(map[string][]*archiveItem)
+	names := make([]string, 0)
+	for i := range items {
+		g := items[i].Group
+		if _, ok := groups[g]; !ok {
+			names = append(names, g)
+		}
+		groups[g] = append(groups[g], items[i])
+	}
+	if len(names) == 1 {
+		return planner(items)
+	}
+	plan := make([]decision, 0, len(items))
+	for _, g := range names {
+		plan = append(plan, planner(groups[g])...)
+	}
+	sortByDate(plan)
+	return plan
+}
+
+// sortByDate sorts plan by archive date, keeping decisions for archives with
+// the same date in their existing order.
+func sortByDate(plan []decision) {
+	sort.SliceStable(plan, func(i, j int) bool {
+		return plan[i].Item.Date.Before(plan[j].Item.Date)
+	})
+}
+
+// discards returns the archives in plan that should be deleted.
+func discards(plan []decision) []*archiveItem {
+	items := make([]*archiveItem, 0)
+	for i := range plan {
+		if plan[i].Action == actionDiscard {
+			items = append(items, plan[i].Item)
+		}
+	}
+	return items
+}
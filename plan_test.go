@@ -0,0 +1,728 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func defaultTiers(t *testing.T, now time.Time, loc *time.Location) tiers {
+	t.Helper()
+	monthly, err := parseAge("2y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	weekly, err := parseAge("2mo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTiers(now, loc, monthly, weekly, weekly)
+}
+
+func TestPlanDiscardsKeepsAllRecentArchives(t *testing.T) {
+	now := time.Now().UTC()
+	buf := new(bytes.Buffer)
+	for i := 20; i > 0; i-- {
+		d := now.AddDate(0, 0, -i)
+		fmt.Fprintf(buf, "hostname-%s\t%s\n", d.Format("2006-01-02_15-04-05"), d.Format("2006-01-02 15:04:05"))
+	}
+	items, err := getArchiveItems(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := planRetention(items, defaultTiers(t, now, time.UTC), map[string]bool{})
+	out := new(bytes.Buffer)
+	writeTextPlan(out, plan, true)
+	if discard := discards(plan); len(discard) != 0 {
+		t.Errorf("discarded %d recent archives, want 0", len(discard))
+	}
+	if n := strings.Count(out.String(), "keep[all] "); n != len(items) {
+		t.Errorf("printed %d keep lines, want %d:\n%s", n, len(items), out.String())
+	}
+}
+
+func TestPlanRetentionTimezoneBoundary(t *testing.T) {
+	// 2024-06-14 19:00 in a UTC-10 zone, but already June 15 in UTC, so the
+	// two-month cutoff is April 14 in the zone and April 15 in UTC.
+	now := time.Date(2024, 6, 15, 5, 0, 0, 0, time.UTC)
+	listing := "hostname-a\t2024-04-07 20:00:00\nhostname-b\t2024-04-08 20:00:00\n"
+	tests := []struct {
+		loc  *time.Location
+		want string
+	}{
+		// a week after hostname-a is April 14 20:00, after the cutoff, so
+		// both archives are in the keep-all tier.
+		{time.FixedZone("UTC-10", -10*60*60), actionKeep},
+		// a week after hostname-a is before the cutoff, so hostname-a
+		// starts a weekly period and hostname-b falls inside it.
+		{time.UTC, actionDiscard},
+	}
+	for _, tt := range tests {
+		items, err := getArchiveItems(strings.NewReader(listing))
+		if err != nil {
+			t.Fatal(err)
+		}
+		setLocation(items, tt.loc)
+		plan := planRetention(items, defaultTiers(t, now, tt.loc), map[string]bool{})
+		if len(plan) != 2 {
+			t.Fatalf("%s: got %d decisions, want 2", tt.loc, len(plan))
+		}
+		if plan[0].Action != actionKeep {
+			t.Errorf("%s: %s: got %s, want keep", tt.loc, plan[0].Item.Name, plan[0].Action)
+		}
+		if plan[1].Action != tt.want {
+			t.Errorf("%s: %s: got %s, want %s", tt.loc, plan[1].Item.Name, plan[1].Action, tt.want)
+		}
+	}
+}
+
+// dailyItems returns one archive per day at midnight UTC, from start to end
+// inclusive.
+func dailyItems(start, end time.Time) []*archiveItem {
+	items := make([]*archiveItem, 0)
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		items = append(items, &archiveItem{Name: "hostname-" + d.Format("2006-01-02"), Date: d})
+	}
+	return items
+}
+
+func TestPlan(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	policy := Policy{
+		Name:         "legacy",
+		MonthlyAfter: age{years: 2},
+		WeeklyAfter:  age{months: 2},
+		KeepAllAfter: age{months: 2},
+		Location:     time.UTC,
+	}
+	day := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name          string
+		items         []*archiveItem
+		keep, discard int
+	}{
+		// Jan 1, Feb 1 and Mar 1
+		{"monthly", dailyItems(day(2021, 1, 1), day(2021, 3, 31)), 3, 87},
+		// Jan 1, 8, 15 and 22
+		{"weekly", dailyItems(day(2024, 1, 1), day(2024, 1, 28)), 4, 24},
+		{"keep all", dailyItems(day(2024, 5, 1), day(2024, 6, 14)), 45, 0},
+		// Jun 16 through 20 are in the future and are neither kept nor
+		// discarded.
+		{"future dated", dailyItems(day(2024, 6, 10), day(2024, 6, 20)), 6, 0},
+	}
+	for _, tt := range tests {
+		keep, discard := Plan(tt.items, policy, now)
+		if len(keep) != tt.keep || len(discard) != tt.discard {
+			t.Errorf("%s: got %d kept, %d discarded, want %d kept, %d discarded", tt.name, len(keep), len(discard), tt.keep, tt.discard)
+		}
+	}
+}
+
+func TestPlanDailyTier(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	policy := Policy{
+		Name:         "legacy",
+		MonthlyAfter: age{years: 2},
+		WeeklyAfter:  age{months: 2},
+		DailyAfter:   &age{},
+		Location:     time.UTC,
+	}
+	// Hourly archives from Jun 10 through 11:00 on Jun 15.
+	var items []*archiveItem
+	for d := time.Date(2024, 6, 10, 0, 0, 0, 0, time.UTC); !d.After(now.Add(-time.Hour)); d = d.Add(time.Hour) {
+		items = append(items, &archiveItem{Name: "hostname-" + d.Format("2006-01-02T15"), Date: d})
+	}
+	if err := policy.validate(now); err != nil {
+		t.Fatal(err)
+	}
+	keep, discard := Plan(items, policy, now)
+	// The first archive on each of Jun 10 to 14, and every archive from
+	// today, which isn't over yet.
+	if len(keep) != 5+12 || len(discard) != 5*23 {
+		t.Errorf("got %d kept, %d discarded, want 17 kept, 115 discarded", len(keep), len(discard))
+	}
+	for _, item := range keep {
+		if item.Date.Day() != 15 && item.Date.Hour() != 0 {
+			t.Errorf("kept %s, want only the first archive of each day", item.Name)
+		}
+	}
+}
+
+// Without -calendar-months, each monthly period starts a calendar month
+// after the last one, clamped to the end of shorter months.
+func TestPlanRetentionMonthlyPeriodsClampToMonthEnd(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	day := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name  string
+		items []*archiveItem
+		keep  []time.Time
+	}{
+		{
+			"year boundary",
+			dailyItems(day(2020, 11, 15), day(2021, 2, 28)),
+			[]time.Time{day(2020, 11, 15), day(2020, 12, 15), day(2021, 1, 15), day(2021, 2, 15)},
+		},
+		{
+			// Jan 31 plus a month is the last day of February, not March 3.
+			"february",
+			dailyItems(day(2021, 1, 31), day(2021, 4, 30)),
+			[]time.Time{day(2021, 1, 31), day(2021, 2, 28), day(2021, 3, 28), day(2021, 4, 28)},
+		},
+		{
+			"leap year",
+			dailyItems(day(2020, 1, 30), day(2020, 3, 31)),
+			[]time.Time{day(2020, 1, 30), day(2020, 2, 29), day(2020, 3, 29)},
+		},
+	}
+	for _, tt := range tests {
+		plan := planRetention(tt.items, defaultTiers(t, now, time.UTC), nil)
+		var kept []time.Time
+		for _, d := range plan {
+			if d.Action == actionKeep {
+				kept = append(kept, d.Item.Date)
+			}
+		}
+		if fmt.Sprint(kept) != fmt.Sprint(tt.keep) {
+			t.Errorf("%s: kept %v, want %v", tt.name, kept, tt.keep)
+		}
+	}
+}
+
+func TestPlanRetentionCalendarMonthBuckets(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	day := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name  string
+		items []*archiveItem
+		keep  []time.Time
+	}{
+		{
+			"year boundary",
+			dailyItems(day(2020, 11, 15), day(2021, 2, 28)),
+			[]time.Time{day(2020, 11, 15), day(2020, 12, 1), day(2021, 1, 1), day(2021, 2, 1)},
+		},
+		{
+			"february",
+			dailyItems(day(2021, 1, 31), day(2021, 4, 30)),
+			[]time.Time{day(2021, 1, 31), day(2021, 2, 1), day(2021, 3, 1), day(2021, 4, 1)},
+		},
+		{
+			// Archives made every ten days don't drift across months.
+			"gaps",
+			[]*archiveItem{
+				{Name: "a", Date: day(2021, 1, 25)},
+				{Name: "b", Date: day(2021, 2, 4)},
+				{Name: "c", Date: day(2021, 2, 14)},
+				{Name: "d", Date: day(2021, 2, 24)},
+				{Name: "e", Date: day(2021, 3, 6)},
+			},
+			[]time.Time{day(2021, 1, 25), day(2021, 2, 4), day(2021, 3, 6)},
+		},
+	}
+	for _, tt := range tests {
+		tr := defaultTiers(t, now, time.UTC)
+		tr.calendarMonths = true
+		var kept []time.Time
+		for _, d := range planRetention(tt.items, tr, nil) {
+			if d.Action == actionKeep {
+				kept = append(kept, d.Item.Date)
+			}
+		}
+		if fmt.Sprint(kept) != fmt.Sprint(tt.keep) {
+			t.Errorf("%s: kept %v, want %v", tt.name, kept, tt.keep)
+		}
+	}
+}
+
+func TestPlanOlderThan(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	policy := Policy{
+		Name:      "legacy",
+		OlderThan: &age{days: 90},
+		Location:  time.UTC,
+	}
+	// 90 days before now is noon on Mar 17.
+	items := dailyItems(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC))
+	keep, discard := Plan(items, policy, now)
+	if len(keep) != 14 || len(discard) != 77 {
+		t.Errorf("got %d kept, %d discarded, want 14 kept, 77 discarded", len(keep), len(discard))
+	}
+}
+
+// replan applies policy to items, then applies it again to the archives it
+// kept, as if the ones it discarded had been deleted, and returns what the
+// second run would discard. A stable policy discards nothing the second time.
+func replan(items []*archiveItem, policy Policy, now time.Time) []*archiveItem {
+	keep, _ := Plan(items, policy, now)
+	_, discard := Plan(keep, policy, now)
+	return discard
+}
+
+func TestPlanIsIdempotent(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	// Archives every 1 to 60 hours for three years, so that periods start
+	// at all sorts of times of day and tier boundaries fall between
+	// archives.
+	r := rand.New(rand.NewSource(1))
+	var items []*archiveItem
+	for d := now.AddDate(-3, 0, 0); d.Before(now); d = d.Add(time.Duration(1+r.Intn(60)) * time.Hour) {
+		items = append(items, &archiveItem{Name: "hostname-" + d.Format("2006-01-02_15-04-05"), Date: d})
+	}
+	legacy := Policy{
+		Name:         "legacy",
+		MonthlyAfter: age{years: 2},
+		WeeklyAfter:  age{months: 2},
+		KeepAllAfter: age{months: 2},
+		Location:     time.UTC,
+	}
+	daily, keepWeek, zone, latest := legacy, legacy, legacy, legacy
+	daily.DailyAfter = &age{days: 10}
+	daily.KeepAllAfter = age{days: 10}
+	keepWeek.KeepAllAfter = age{days: 7}
+	zone.Location = time.FixedZone("UTC-10", -10*60*60)
+	latest.KeepLatest = 5
+	latest.MinAge = age{days: 3}
+	tests := []struct {
+		name   string
+		policy Policy
+	}{
+		{"legacy", legacy},
+		{"daily tier", daily},
+		{"keep all for a week", keepWeek},
+		{"time zone", zone},
+		{"keep latest", latest},
+		{"gfs", Policy{Name: "gfs", GFS: gfsCounts{daily: 7, weekly: 4, monthly: 12, yearly: 3}, Location: time.UTC}},
+		{"older than", Policy{Name: "legacy", OlderThan: &age{days: 90}, Location: time.UTC}},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.validate(now); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if discard := replan(items, tt.policy, now); len(discard) != 0 {
+			t.Errorf("%s: replanning the kept archives discards %d more, starting with %s", tt.name, len(discard), discard[0].Name)
+		}
+	}
+}
+
+func TestPlanGroupPolicy(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	base := Policy{
+		Name:         "legacy",
+		MonthlyAfter: age{years: 2},
+		WeeklyAfter:  age{months: 2},
+		KeepAllAfter: age{months: 2},
+		Location:     time.UTC,
+	}
+	group, web, err := parseGroupPolicy("web01:older-than=30d", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group != "web01" {
+		t.Fatalf("got group %q, want web01", group)
+	}
+	pol := base
+	pol.Groups = map[string]Policy{group: web}
+	if err := pol.validate(now); err != nil {
+		t.Fatal(err)
+	}
+	start, end := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 14, 0, 0, 0, 0, time.UTC)
+	webItems, dbItems := dailyItems(start, end), dailyItems(start, end)
+	var items []*archiveItem
+	for i := range webItems {
+		webItems[i].Name, webItems[i].Group = "web01-"+webItems[i].Name, "web01"
+		dbItems[i].Name, dbItems[i].Group = "db01-"+dbItems[i].Name, "db01"
+		items = append(items, dbItems[i], webItems[i])
+	}
+	keep, discard := Plan(items, pol, now)
+	// 30 days before now is noon on May 16.
+	dbKeep, dbDiscard := Plan(dbItems, base, now)
+	wantKeep, wantDiscard := len(dbKeep)+29, len(dbDiscard)+77
+	if len(keep) != wantKeep || len(discard) != wantDiscard {
+		t.Errorf("got %d kept, %d discarded, want %d kept, %d discarded", len(keep), len(discard), wantKeep, wantDiscard)
+	}
+	for _, spec := range []string{"host=web01:older-than=30d", "group=web01:older-than=30d"} {
+		if group, _, err := parseGroupPolicy(spec, base); err != nil || group != "web01" {
+			t.Errorf("%q: got group %q, %v, want web01", spec, group, err)
+		}
+	}
+	for _, spec := range []string{"web01", "web01:", "web01:color=blue", "web01:keep-latest=many"} {
+		if _, _, err := parseGroupPolicy(spec, base); err == nil {
+			t.Errorf("%q: expected an error, got nil", spec)
+		}
+	}
+}
+
+func TestPlanByGroup(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	tiers := defaultTiers(t, now, time.UTC)
+	// Two hosts backing up every day, twelve hours apart, so their dates
+	// interleave. Planned together, one host's archive would fall inside
+	// the other's weekly period.
+	start, end := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)
+	webItems, dbItems := dailyItems(start, end), dailyItems(start.Add(12*time.Hour), end.Add(12*time.Hour))
+	var items []*archiveItem
+	for i := range webItems {
+		webItems[i].Name, webItems[i].Group = "web-"+webItems[i].Name, "web"
+		dbItems[i].Name, dbItems[i].Group = "db-"+dbItems[i].Name, "db"
+		items = append(items, webItems[i], dbItems[i])
+	}
+	var groups []string
+	plan := planByGroup(items, func(items []*archiveItem) []decision {
+		for _, item := range items[1:] {
+			if item.Group != items[0].Group {
+				t.Fatalf("planned %s with the %s group", item.Name, items[0].Group)
+			}
+		}
+		groups = append(groups, items[0].Group)
+		return planRetention(items, tiers, nil)
+	})
+	if fmt.Sprint(groups) != "[web db]" {
+		t.Errorf("planned groups %v, want [web db] in the order they first appear", groups)
+	}
+	if len(plan) != len(items) {
+		t.Fatalf("got %d decisions, want %d", len(plan), len(items))
+	}
+	for i := range plan {
+		if i > 0 && plan[i].Item.Date.Before(plan[i-1].Item.Date) {
+			t.Fatalf("decisions aren't sorted by date: %s before %s", plan[i-1].Item.Name, plan[i].Item.Name)
+		}
+	}
+	// Each group gets the same decisions it would get on its own.
+	want := make(map[string]string)
+	for _, d := range append(planRetention(webItems, tiers, nil), planRetention(dbItems, tiers, nil)...) {
+		want[d.Item.Name] = d.label()
+	}
+	kept := make(map[string]int)
+	for _, d := range plan {
+		if d.label() != want[d.Item.Name] {
+			t.Errorf("%s: got %s, want %s", d.Item.Name, d.label(), want[d.Item.Name])
+		}
+		if d.Action == actionKeep {
+			kept[d.Item.Group]++
+		}
+	}
+	if kept["web"] == 0 || kept["web"] != kept["db"] {
+		t.Errorf("kept %d web and %d db archives, want the same number of each", kept["web"], kept["db"])
+	}
+}
+
+func TestKeepNewestPerGroup(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	plan := []decision{
+		{&archiveItem{Name: "web-1", Date: day(1), Group: "web"}, actionDiscard, ""},
+		{&archiveItem{Name: "db-1", Date: day(1), Group: "db"}, actionDiscard, ""},
+		{&archiveItem{Name: "web-2", Date: day(2), Group: "web"}, actionDiscard, ""},
+		{&archiveItem{Name: "db-2", Date: day(2), Group: "db"}, actionKeep, "monthly"},
+		{&archiveItem{Name: "web-3", Date: day(3), Group: "web"}, actionGone, ""},
+	}
+	keepNewestPerGroup(plan)
+	var got []string
+	for _, d := range plan {
+		got = append(got, d.label()+" "+d.Item.Name)
+	}
+	want := []string{"discard web-1", "discard db-1", "keep[newest-in-group] web-2", "keep[monthly] db-2", "gone web-3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestKeepLatest(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	newPlan := func() []decision {
+		return []decision{
+			{&archiveItem{Name: "undated"}, actionKeep, "undated"},
+			{&archiveItem{Name: "a-1", Date: day(1)}, actionDiscard, ""},
+			{&archiveItem{Name: "a-2", Date: day(2)}, actionDiscard, ""},
+			{&archiveItem{Name: "a-3", Date: day(3)}, actionKeep, "monthly"},
+			{&archiveItem{Name: "a-4", Date: day(4)}, actionDiscard, ""},
+			{&archiveItem{Name: "a-5", Date: day(5)}, actionGone, ""},
+		}
+	}
+	tests := []struct {
+		n    int
+		want []string
+	}{
+		{0, []string{"keep[undated] undated", "discard a-1", "discard a-2", "keep[monthly] a-3", "discard a-4", "gone a-5"}},
+		// a-5 is gone, so it doesn't count, and a-3 is already kept, but
+		// does.
+		{2, []string{"keep[undated] undated", "discard a-1", "discard a-2", "keep[monthly] a-3", "keep[latest] a-4", "gone a-5"}},
+		{3, []string{"keep[undated] undated", "discard a-1", "keep[latest] a-2", "keep[monthly] a-3", "keep[latest] a-4", "gone a-5"}},
+		// more than there are archives
+		{10, []string{"keep[undated] undated", "keep[latest] a-1", "keep[latest] a-2", "keep[monthly] a-3", "keep[latest] a-4", "gone a-5"}},
+	}
+	for _, tt := range tests {
+		plan := newPlan()
+		keepLatest(plan, tt.n)
+		var got []string
+		for _, d := range plan {
+			got = append(got, d.label()+" "+d.Item.Name)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("keepLatest(%d): got %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPlanMaxAge(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	policy := Policy{
+		Name:         "legacy",
+		MonthlyAfter: age{years: 2},
+		WeeklyAfter:  age{months: 2},
+		KeepAllAfter: age{months: 2},
+		MaxAge:       &age{years: 7},
+		MinAge:       age{days: 14},
+		KeepLatest:   1,
+		Location:     time.UTC,
+	}
+	if err := policy.validate(now); err != nil {
+		t.Fatal(err)
+	}
+	var items []*archiveItem
+	for year := 2014; year <= 2024; year++ {
+		d := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		items = append(items, &archiveItem{Name: d.Format("hostname-2006"), Date: d})
+	}
+	keep, discard := Plan(items, policy, now)
+	// Everything before noon on Jun 15, 2017 goes: 2014 through 2017.
+	if len(keep) != 7 || len(discard) != 4 || discard[3].Name != "hostname-2017" {
+		t.Errorf("got %d kept, %d discarded (%v), want 7 kept, 4 discarded", len(keep), len(discard), discard)
+	}
+	// keep-latest still applies
+	keep, _ = Plan(items[:2], policy, now)
+	if len(keep) != 1 || keep[0].Name != "hostname-2015" {
+		t.Errorf("kept %v, want hostname-2015", keep)
+	}
+	policy.MaxAge = &age{days: 7}
+	if err := policy.validate(now); err == nil {
+		t.Error("expected an error for a -max-age shorter than -min-age, got nil")
+	}
+}
+
+func TestPlanMinAge(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	// Weekly thinning starts after a week, so without -min-age most of the
+	// last two weeks would go.
+	policy := Policy{
+		Name:         "legacy",
+		MonthlyAfter: age{years: 2},
+		WeeklyAfter:  age{days: 7},
+		KeepAllAfter: age{days: 7},
+		MinAge:       age{days: 14},
+		Location:     time.UTC,
+	}
+	other := policy
+	other.MinAge = age{}
+	policy.Groups = map[string]Policy{"db": other}
+	if err := policy.validate(now); err != nil {
+		t.Fatal(err)
+	}
+	var items []*archiveItem
+	for _, item := range dailyItems(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 14, 0, 0, 0, 0, time.UTC)) {
+		web, db := *item, *item
+		web.Name, web.Group = "web-"+item.Name, "web"
+		db.Name, db.Group = "db-"+item.Name, "db"
+		items = append(items, &db, &web)
+	}
+	cutoff := policy.MinAge.before(now)
+	check := func(name string, plan []decision) {
+		t.Helper()
+		var keptByMinAge, dbDiscardedRecently int
+		for _, d := range plan {
+			recent := d.Item.Date.After(cutoff)
+			switch {
+			case d.Item.Group == "web" && recent && d.Action == actionDiscard:
+				t.Errorf("%s: discarded %s, inside -min-age", name, d.Item.Name)
+			case d.Item.Group == "web" && !recent && d.Reason == "min-age":
+				t.Errorf("%s: kept %s by -min-age, but it's older than that", name, d.Item.Name)
+			case d.Item.Group == "db" && d.Reason == "min-age":
+				t.Errorf("%s: kept %s by -min-age, but its group's -min-age is 0", name, d.Item.Name)
+			case d.Item.Group == "db" && recent && d.Action == actionDiscard:
+				dbDiscardedRecently++
+			}
+			if d.Reason == "min-age" {
+				keptByMinAge++
+			}
+		}
+		if keptByMinAge == 0 {
+			t.Errorf("%s: -min-age didn't keep any archive the plan discarded", name)
+		}
+		if dbDiscardedRecently == 0 {
+			t.Errorf("%s: the db group's policy didn't discard any recent archive", name)
+		}
+	}
+	check("retention", policy.decide(items, now, nil))
+	// -delete-all-matching discards everything else, but not what
+	// -min-age protects.
+	plan := discardAll(items, nil)
+	policy.keepMinAge(plan, now)
+	check("-delete-all-matching", plan)
+}
+
+func TestPlanHourlyListing(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	start := now.AddDate(-3, 0, 0)
+	n := int(now.Sub(start) / time.Hour)
+	items, err := getArchiveItems(strings.NewReader(GenerateListing(start, time.Hour, n, "hostname-")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiers := defaultTiers(t, now, time.UTC)
+	plan := planRetention(items, tiers, nil)
+	var prev time.Time
+	for _, d := range plan {
+		if d.Action != actionKeep {
+			if d.Item.Date.After(tiers.keepAll) {
+				t.Errorf("discarded %s, which is newer than %v", d.Item, tiers.keepAll)
+			}
+			continue
+		}
+		date := d.Item.Date
+		switch {
+		case !prev.IsZero() && addMonths(prev, 1).Before(tiers.monthly) && date.Before(addMonths(prev, 1)):
+			t.Errorf("kept %s less than a month after %v", d.Item, prev)
+		case !prev.IsZero() && prev.AddDate(0, 0, 7).Before(tiers.weekly) && date.Before(prev.AddDate(0, 0, 7)):
+			t.Errorf("kept %s less than a week after %v", d.Item, prev)
+		}
+		prev = date
+	}
+}
+
+func TestPlanRetentionWeekStart(t *testing.T) {
+	day := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	}
+	monday, sunday := time.Monday, time.Sunday
+	tests := []struct {
+		name      string
+		weekStart *time.Weekday
+		items     []*archiveItem
+		keep      []time.Time
+	}{
+		{
+			"seven days",
+			nil,
+			dailyItems(day(2024, 3, 6, 0), day(2024, 4, 10, 0)),
+			[]time.Time{day(2024, 3, 6, 0), day(2024, 3, 13, 0), day(2024, 3, 20, 0), day(2024, 3, 27, 0), day(2024, 4, 3, 0), day(2024, 4, 10, 0)},
+		},
+		{
+			// Mar 6 2024 is a Wednesday.
+			"monday",
+			&monday,
+			dailyItems(day(2024, 3, 6, 0), day(2024, 4, 10, 0)),
+			[]time.Time{day(2024, 3, 6, 0), day(2024, 3, 11, 0), day(2024, 3, 18, 0), day(2024, 3, 25, 0), day(2024, 4, 1, 0), day(2024, 4, 8, 0)},
+		},
+		{
+			"year boundary",
+			&sunday,
+			dailyItems(day(2020, 12, 24, 0), day(2021, 1, 12, 0)),
+			[]time.Time{day(2020, 12, 24, 0), day(2020, 12, 27, 0), day(2021, 1, 3, 0), day(2021, 1, 10, 0)},
+		},
+		{
+			// Two hours apart, but on either side of midnight on Sunday.
+			"sunday night",
+			&monday,
+			[]*archiveItem{
+				{Name: "a", Date: day(2024, 3, 3, 23)},
+				{Name: "b", Date: day(2024, 3, 4, 1)},
+				{Name: "c", Date: day(2024, 3, 8, 0)},
+				{Name: "d", Date: day(2024, 3, 11, 0)},
+			},
+			[]time.Time{day(2024, 3, 3, 23), day(2024, 3, 4, 1), day(2024, 3, 11, 0)},
+		},
+	}
+	for _, tt := range tests {
+		tr := tiers{weekly: day(2024, 6, 1, 0), keepAll: day(2024, 6, 1, 0), weekStart: tt.weekStart}
+		var kept []time.Time
+		for _, d := range planRetention(tt.items, tr, nil) {
+			if d.Action == actionKeep {
+				kept = append(kept, d.Item.Date)
+			}
+		}
+		if fmt.Sprint(kept) != fmt.Sprint(tt.keep) {
+			t.Errorf("%s: kept %v, want %v", tt.name, kept, tt.keep)
+		}
+	}
+}
+
+func TestParseWeekday(t *testing.T) {
+	for _, s := range []string{"monday", "Monday", "MON", "mon"} {
+		if d, err := parseWeekday(s); err != nil || d != time.Monday {
+			t.Errorf("parseWeekday(%q) = %v, %v, want Monday", s, d, err)
+		}
+	}
+	for _, s := range []string{"", "mo", "mondays", "1"} {
+		if _, err := parseWeekday(s); err == nil {
+			t.Errorf("parseWeekday(%q): got nil error, want one", s)
+		}
+	}
+}
+
+func TestPlanKeepAllAfterLongerThanWeekly(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	items := dailyItems(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 14, 0, 0, 0, 0, time.UTC))
+	policy := func(keepAll age) Policy {
+		return Policy{
+			Name:         "legacy",
+			MonthlyAfter: age{years: 2},
+			WeeklyAfter:  age{months: 2},
+			KeepAllAfter: keepAll,
+			Location:     time.UTC,
+		}
+	}
+	short, long := policy(age{months: 2}), policy(age{months: 3})
+	for _, p := range []Policy{short, long} {
+		if err := p.validate(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, shortDiscard := Plan(items, short, now)
+	_, longDiscard := Plan(items, long, now)
+	if len(longDiscard) >= len(shortDiscard) {
+		t.Errorf("-keep-all-after=3mo discarded %d archives, want fewer than the %d for 2mo", len(longDiscard), len(shortDiscard))
+	}
+	cutoff := age{months: 3}.before(startOfDay(now, time.UTC))
+	for _, item := range longDiscard {
+		if item.Date.After(cutoff) {
+			t.Errorf("discarded %s, which is newer than -keep-all-after", item.Name)
+		}
+	}
+}
+
+func TestPlanRetentionTierNearCutoffs(t *testing.T) {
+	day := func(month time.Month, day int) time.Time {
+		return time.Date(2022, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	tr := tiers{monthly: day(6, 20), weekly: day(8, 1), keepAll: day(8, 1)}
+	items := append(dailyItems(day(5, 10), day(6, 12)), dailyItems(day(7, 29), day(7, 31))...)
+	want := map[time.Time]string{
+		// a month after May 10 is before -monthly-after
+		day(5, 10): "monthly",
+		// a month after Jun 10 isn't, so it starts a week instead
+		day(6, 10): "weekly",
+		// and a week after Jul 29 is after -weekly-after, so nothing is
+		// thinned
+		day(7, 29): "all",
+		day(7, 30): "all",
+		day(7, 31): "all",
+	}
+	got := make(map[time.Time]string)
+	for _, d := range planRetention(items, tr, nil) {
+		if d.Action == actionKeep {
+			got[d.Item.Date] = d.Reason
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often progress is printed when the output isn't a
+// terminal.
+const progressInterval = 10 * time.Second
+
+// A progress prints how many of total archives have been dealt with. On a
+// terminal it redraws a single line; otherwise it prints a line at most once
+// every progressInterval, and once more at the end. A nil *progress prints
+// nothing. It is safe for concurrent use.
+type progress struct {
+	w     io.Writer
+	tty   bool
+	total int64
+	done  atomic.Int64
+
+	mu      sync.Mutex
+	printed time.Time
+}
+
+func newProgress(w io.Writer, tty bool, total int) *progress {
+	return &progress{w: w, tty: tty, total: int64(total)}
+}
+
+// add records that n more archives are done.
+func (p *progress) add(n int) {
+	if p == nil {
+		return
+	}
+	done := p.done.Add(int64(n))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if !p.tty && done < p.total && now.Sub(p.printed) < progressInterval {
+		return
+	}
+	p.printed = now
+	pct := int64(100)
+	if p.total > 0 {
+		pct = done * 100 / p.total
+	}
+	if p.tty {
+		fmt.Fprintf(p.w, "\rdeleted %d/%d (%d%%)", done, p.total, pct)
+	} else {
+		fmt.Fprintf(p.w, "deleted %d/%d (%d%%)\n", done, p.total, pct)
+	}
+}
+
+// finish ends the line drawn on a terminal.
+func (p *progress) finish() {
+	if p == nil || !p.tty || p.done.Load() == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintln(p.w)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// fetchSizes sets the Size of each item using tarsnap --print-stats. This
+// runs tarsnap once per archive, so it's slow on large accounts.
+func fetchSizes(ctx context.Context, t tarsnapCmd, items []*archiveItem) error {
+	for i := range items {
+		buf := new(bytes.Buffer)
+		errBuf := new(bytes.Buffer)
+		if err := t.run(ctx, buf, errBuf, "--print-stats", "-f", items[i].Name); err != nil {
+			return fmt.Errorf("could not get size of %s: %v: %s", items[i].Name, err, strings.TrimSpace(errBuf.String()))
+		}
+		size, err := parseArchiveSize(buf, items[i].Name)
+		if err != nil {
+			return err
+		}
+		items[i].Size = size
+	}
+	return nil
+}
+
+// parseArchiveSize finds the row for name in tarsnap --print-stats output,
+// which looks like this, and returns its compressed size:
+//
+//	                                       Total size  Compressed size
+//	All archives                            2956284106       1683028462
+//	  (unique data)                          108255261         49253151
+//	hostname-2018-04-21_08-55-35              30197363         13604636
+//	  (unique data)                             482593           193931
+func parseArchiveSize(r io.Reader, name string) (int64, error) {
+	bs := bufio.NewScanner(r)
+	for bs.Scan() {
+		line := bs.Text()
+		if !strings.HasPrefix(line, name) {
+			continue
+		}
+		fields := strings.Fields(line[len(name):])
+		if len(fields) != 2 {
+			continue
+		}
+		if _, err := strconv.ParseInt(fields[0], 10, 64); err != nil {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		return size, nil
+	}
+	if err := bs.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no size for %s in tarsnap --print-stats output", name)
+}
+
+// parseDeletedBytes adds up the compressed sizes in the "Deleted data" rows
+// of tarsnap -d --print-stats output, which has a block like this for each
+// archive deleted:
+//
+//	                                       Total size  Compressed size
+//	All archives                            2926086743       1669424312
+//	  (unique data)                          107772668         49059220
+//	This archive                              30197363         13604636
+//	Deleted data                                482593           193931
+func parseDeletedBytes(r io.Reader) (int64, error) {
+	var total int64
+	found := false
+	bs := bufio.NewScanner(r)
+	for bs.Scan() {
+		fields := strings.Fields(bs.Text())
+		if len(fields) != 4 || fields[0] != "Deleted" || fields[1] != "data" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return total, fmt.Errorf("bad deleted size %q: %v", fields[3], err)
+		}
+		total += size
+		found = true
+	}
+	if err := bs.Err(); err != nil {
+		return total, err
+	}
+	if !found {
+		return 0, errors.New(`no "Deleted data" row in tarsnap --print-stats output`)
+	}
+	return total, nil
+}
+
+// totalSize returns the sum of the sizes of items. Archives share
+// deduplicated data, so deleting them may free less than this.
+func totalSize(items []*archiveItem) int64 {
+	var total int64
+	for i := range items {
+		total += items[i].Size
+	}
+	return total
+}
+
+// discardLargestUntil changes plan so that only the largest of the archives
+// it discards are deleted, taking them largest first until their sizes add up
+// to at least target bytes. The rest are kept. It returns the total size of
+// the archives still discarded.
+func discardLargestUntil(plan []decision, target int64) int64 {
+	idx := make([]int, 0)
+	for i := range plan {
+		if plan[i].Action == actionDiscard {
+			idx = append(idx, i)
+		}
+	}
+	// largest first, then oldest first
+	slices.SortStableFunc(idx, func(a, b int) int {
+		return cmp.Compare(plan[b].Item.Size, plan[a].Item.Size)
+	})
+	var total int64
+	for _, i := range idx {
+		if total >= target {
+			slog.Debug("kept by -target-free", "archive", plan[i].Item.Name)
+			plan[i].Action = actionKeep
+			plan[i].Reason = "target-met"
+			continue
+		}
+		total += plan[i].Item.Size
+	}
+	return total
+}
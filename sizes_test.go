@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDeletedBytes(t *testing.T) {
+	out := `                                       Total size  Compressed size
+All archives                            2926086743       1669424312
+  (unique data)                          107772668         49059220
+This archive                              30197363         13604636
+Deleted data                                482593           193931
+                                       Total size  Compressed size
+All archives                            2895889380       1655819676
+  (unique data)                          107290075         48865289
+This archive                              30197363         13604636
+Deleted data                                 10000             5000
+`
+	n, err := parseDeletedBytes(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 193931+5000 {
+		t.Errorf("got %d bytes freed, want %d", n, 193931+5000)
+	}
+	if _, err := parseDeletedBytes(strings.NewReader("")); err == nil {
+		t.Error("expected an error for output with no stats, got nil")
+	}
+}
+
+func TestDiscardLargestUntil(t *testing.T) {
+	plan := []decision{
+		{&archiveItem{Name: "a", Size: 10}, actionDiscard, ""},
+		{&archiveItem{Name: "b", Size: 50}, actionDiscard, ""},
+		{&archiveItem{Name: "c", Size: 100}, actionKeep, "monthly"},
+		{&archiveItem{Name: "d", Size: 30}, actionDiscard, ""},
+		{&archiveItem{Name: "e", Size: 30}, actionDiscard, ""},
+	}
+	if got := discardLargestUntil(plan, 70); got != 80 {
+		t.Errorf("selected %d bytes, want 80", got)
+	}
+	var discarded []string
+	for _, item := range discards(plan) {
+		discarded = append(discarded, item.Name)
+	}
+	// b, then the older of the two 30 byte archives
+	if got := strings.Join(discarded, " "); got != "b d" {
+		t.Errorf("discarded %s, want b d", got)
+	}
+	if plan[0].label() != "keep[target-met]" {
+		t.Errorf("a: got %s, want keep[target-met]", plan[0].label())
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// planStreamAddr reports whether name, a -plan-out value, is a network
+// address like unix:/run/dash.sock or tcp:localhost:9000 rather than a file
+// name, and if so returns the network and address to dial.
+func planStreamAddr(name string) (network, addr string, ok bool) {
+	for _, network := range []string{"unix", "tcp"} {
+		if addr, ok := strings.CutPrefix(name, network+":"); ok {
+			return network, addr, true
+		}
+	}
+	return "", "", false
+}
+
+// planEvent is a line sent to a -plan-out address for each archive in the
+// plan, as soon as the plan has been made.
+type planEvent struct {
+	Event string `json:"event"`
+	jsonEntry
+}
+
+// resultEvent is a line sent to a -plan-out address each time the deleter
+// deals with an archive.
+type resultEvent struct {
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+	Name   string    `json:"name"`
+	Result string    `json:"result"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// A planStream writes newline-delimited JSON events to a connection, for a
+// -plan-out address. It is safe for concurrent use. Once a write fails, a
+// warning is logged and later events are dropped, so that a monitoring UI
+// going away doesn't stop the run. A nil *planStream discards everything.
+type planStream struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	enc    *json.Encoder
+	failed bool
+}
+
+func dialPlanStream(network, addr string) (*planStream, error) {
+	conn, err := net.DialTimeout(network, addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &planStream{conn: conn, enc: json.NewEncoder(conn)}, nil
+}
+
+func (s *planStream) send(v any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed {
+		return
+	}
+	if err := s.enc.Encode(v); err != nil {
+		slog.Warn("could not write to -plan-out, dropping further events", "addr", s.conn.RemoteAddr(), "err", err)
+		s.failed = true
+	}
+}
+
+// sendPlan sends a "plan" event for each decision in plan.
+func (s *planStream) sendPlan(plan []decision) {
+	for i := range plan {
+		s.send(planEvent{"plan", jsonEntry{
+			Name:   plan[i].Item.Name,
+			Date:   plan[i].Item.Date,
+			Action: plan[i].Action,
+			Size:   plan[i].Item.Size,
+			Group:  plan[i].Item.Group,
+			Reason: plan[i].Reason,
+		}})
+	}
+}
+
+// sendResults sends a "result" event for each of archives.
+func (s *planStream) sendResults(archives []string, result string, err error) {
+	e := resultEvent{Event: "result", Time: time.Now().UTC(), Result: result}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	for _, name := range archives {
+		e.Name = name
+		s.send(e)
+	}
+}
+
+func (s *planStream) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// confirm writes question to w and reports whether the answer read from r
+// was "y" or "yes". Anything else, including EOF, counts as no.
+func confirm(r io.Reader, w io.Writer, question string) bool {
+	fmt.Fprintf(w, "%s [y/N] ", question)
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && line == "" {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// approveEach asks, for each of items in turn, whether to delete it, and
+// returns the names of the approved archives. Answering "a" approves the
+// item and every one after it; "q" stops asking, keeping the approvals given
+// so far. Anything else, including EOF, counts as no.
+func approveEach(r io.Reader, w io.Writer, items []*archiveItem) map[string]bool {
+	approved := make(map[string]bool)
+	br := bufio.NewReader(r)
+	for i, item := range items {
+		fmt.Fprintf(w, "delete %s (%s)? [y/N/a/q] ", item.Name, item.Date.Format("2006-01-02 15:04:05"))
+		line, err := br.ReadString('\n')
+		if err != nil && line == "" {
+			return approved
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			approved[item.Name] = true
+		case "a":
+			for _, rest := range items[i:] {
+				approved[rest.Name] = true
+			}
+			return approved
+		case "q":
+			return approved
+		}
+	}
+	return approved
+}